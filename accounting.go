@@ -0,0 +1,479 @@
+package wiretunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAccountingSaveInterval = time.Minute
+
+	// accountingFlushInterval is the interval at which the bytes counted by the relays
+	// in progress are added to the usage.
+	accountingFlushInterval = 5 * time.Second
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota is the number of bytes a user may upload and download together per day and per
+// month, 0 is unlimited.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// Usage is a number of bytes uploaded and downloaded.
+type Usage struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// UserUsage is the data transferred by a user in total, during the current day and
+// month in local time, and to every destination host.
+type UserUsage struct {
+	Total        Usage            `json:"total"`
+	Day          string           `json:"day"`
+	Daily        Usage            `json:"daily"`
+	Month        string           `json:"month"`
+	Monthly      Usage            `json:"monthly"`
+	Destinations map[string]Usage `json:"destinations"`
+}
+
+// AccountingConfig is the configuration of NewAccounting.
+type AccountingConfig struct {
+	// File is the path of the file the usage is persisted to, loaded at start and saved
+	// every SaveInterval, default 1m.
+	File         string
+	SaveInterval time.Duration
+
+	// Quota is the quota of every authenticated user, Quotas overrides it for some
+	// users. New connections of the users exceeding their quota are rejected.
+	Quota  Quota
+	Quotas map[string]Quota
+}
+
+// Accounting counts the bytes relayed by the proxies per user and destination, the
+// traffic of unauthenticated clients is accounted to the empty user. Every relay counts
+// its bytes on its own and adds them to the usage periodically and when it is closed.
+// It may be shared by several servers.
+type Accounting struct {
+	mutex  sync.Mutex
+	users  map[string]*UserUsage
+	file   string
+	quota  Quota
+	quotas map[string]Quota
+
+	metersMutex sync.Mutex
+	meters      map[*accountMeter]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewAccounting returns the accounting of the configuration, loading its file.
+func NewAccounting(cfg *AccountingConfig) (*Accounting, error) {
+	a := &Accounting{
+		users:  make(map[string]*UserUsage),
+		file:   cfg.File,
+		quota:  cfg.Quota,
+		quotas: cfg.Quotas,
+		meters: make(map[*accountMeter]struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if a.file != "" {
+		err := a.load()
+		if err != nil {
+			return nil, fmt.Errorf("accounting file: %w", err)
+		}
+		interval := cfg.SaveInterval
+		if interval <= 0 {
+			interval = defaultAccountingSaveInterval
+		}
+		go a.saveLoop(interval)
+	}
+	go a.flushLoop()
+
+	return a, nil
+}
+
+// Usage returns the usage of every user.
+func (a *Accounting) Usage() map[string]UserUsage {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	usage := make(map[string]UserUsage, len(a.users))
+	for user, u := range a.users {
+		u.rollover(now)
+		c := *u
+		c.Destinations = maps.Clone(u.Destinations)
+		usage[user] = c
+	}
+	return usage
+}
+
+// rollover resets the daily and monthly usage when the day or month changed.
+func (u *UserUsage) rollover(now time.Time) {
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day = day
+		u.Daily = Usage{}
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.Monthly = Usage{}
+	}
+}
+
+func (a *Accounting) userQuota(user string) Quota {
+	if q, ok := a.quotas[user]; ok {
+		return q
+	}
+	return a.quota
+}
+
+// exceeded returns the period of the quota the usage exceeds, if any.
+func (q Quota) exceeded(u *UserUsage) string {
+	switch {
+	case q.Daily > 0 && u.Daily.Upload+u.Daily.Download >= q.Daily:
+		return "daily"
+	case q.Monthly > 0 && u.Monthly.Upload+u.Monthly.Download >= q.Monthly:
+		return "monthly"
+	}
+	return ""
+}
+
+// checkQuota returns an error if the user exceeded its quota.
+func (a *Accounting) checkQuota(user string) error {
+	if a == nil || user == "" {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	u, ok := a.users[user]
+	if !ok {
+		return nil
+	}
+	u.rollover(time.Now())
+	if period := a.userQuota(user).exceeded(u); period != "" {
+		return fmt.Errorf("%w: %s quota of user %q", errQuotaExceeded, period, user)
+	}
+	return nil
+}
+
+// add accounts the bytes uploaded and downloaded by the user to the destination.
+func (a *Accounting) add(user, dest string, upload, download int64) {
+	if upload == 0 && download == 0 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	u, ok := a.users[user]
+	if !ok {
+		u = &UserUsage{Destinations: make(map[string]Usage)}
+		a.users[user] = u
+	}
+	u.rollover(time.Now())
+
+	q := a.userQuota(user)
+	before := q.exceeded(u)
+
+	u.Total.Upload += upload
+	u.Total.Download += download
+	u.Daily.Upload += upload
+	u.Daily.Download += download
+	u.Monthly.Upload += upload
+	u.Monthly.Download += download
+	d := u.Destinations[dest]
+	d.Upload += upload
+	d.Download += download
+	u.Destinations[dest] = d
+
+	if period := q.exceeded(u); user != "" && period != "" && before == "" {
+		log.Printf("Accounting: WARNING: user %q exceeded its %s quota", user, period)
+	}
+}
+
+// load loads the usage of the file, a missing file is empty.
+func (a *Accounting) load() error {
+	b, err := os.ReadFile(a.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	users := make(map[string]*UserUsage)
+	err = json.Unmarshal(b, &users)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.Destinations == nil {
+			u.Destinations = make(map[string]Usage)
+		}
+	}
+
+	a.mutex.Lock()
+	a.users = users
+	a.mutex.Unlock()
+
+	log.Printf("Accounting: INFO: loaded the usage of %d users from %s", len(users), a.file)
+	return nil
+}
+
+// Save writes the usage to the accounting file, if any.
+func (a *Accounting) Save() error {
+	if a.file == "" {
+		return nil
+	}
+
+	a.mutex.Lock()
+	b, err := json.MarshalIndent(a.users, "", "  ")
+	a.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a truncated usage file
+	f, err := os.CreateTemp(filepath.Dir(a.file), filepath.Base(a.file)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), a.file)
+}
+
+func (a *Accounting) saveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+
+		err := a.Save()
+		if err != nil {
+			log.Printf("Accounting: WARNING: failed to save usage: %v", err)
+		}
+	}
+}
+
+func (a *Accounting) flushLoop() {
+	ticker := time.NewTicker(accountingFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+		a.flush()
+	}
+}
+
+// flush adds the bytes counted by the relays in progress to the usage.
+func (a *Accounting) flush() {
+	a.metersMutex.Lock()
+	meters := make([]*accountMeter, 0, len(a.meters))
+	for m := range a.meters {
+		meters = append(meters, m)
+	}
+	a.metersMutex.Unlock()
+
+	for _, m := range meters {
+		m.flush()
+	}
+}
+
+// Close stops saving the usage periodically and saves it with the bytes counted by the
+// relays in progress.
+func (a *Accounting) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.done)
+	})
+	a.flush()
+	return a.Save()
+}
+
+// destinationHost returns the host of the destination address, without its port.
+func destinationHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// conn accounts the bytes of the connection to upstream of the user: writes are uploads
+// and reads downloads.
+func (a *Accounting) conn(c net.Conn, user, dest string) net.Conn {
+	if a == nil {
+		return c
+	}
+	return &accountedConn{Conn: c, meter: a.newMeter(user, dest)}
+}
+
+// readWriteCloser is conn for the upstream connections which are not a net.Conn.
+func (a *Accounting) readWriteCloser(rwc io.ReadWriteCloser, user, dest string) io.ReadWriteCloser {
+	if a == nil {
+		return rwc
+	}
+	return &accountedReadWriteCloser{ReadWriteCloser: rwc, meter: a.newMeter(user, dest)}
+}
+
+// body accounts a request body to upstream if upload is true, or else a response body
+// to the client.
+func (a *Accounting) body(rc io.ReadCloser, user, dest string, upload bool) io.ReadCloser {
+	if a == nil {
+		return rc
+	}
+	return &accountedReadCloser{ReadCloser: rc, meter: a.newMeter(user, dest), upload: upload}
+}
+
+// newMeter returns the meter of a relay of the user to the destination, it must be
+// closed once done.
+func (a *Accounting) newMeter(user, dest string) *accountMeter {
+	m := &accountMeter{accounting: a, user: user, dest: destinationHost(dest)}
+	a.metersMutex.Lock()
+	a.meters[m] = struct{}{}
+	a.metersMutex.Unlock()
+	return m
+}
+
+// accountMeter counts the bytes of a relay of the user to the destination without
+// locking, until they are flushed to the usage.
+type accountMeter struct {
+	accounting *Accounting
+	user       string
+	dest       string
+
+	up        atomic.Int64
+	down      atomic.Int64
+	closeOnce sync.Once
+}
+
+func (m *accountMeter) upload(n int) {
+	m.up.Add(int64(n))
+}
+
+func (m *accountMeter) download(n int) {
+	m.down.Add(int64(n))
+}
+
+func (m *accountMeter) flush() {
+	m.accounting.add(m.user, m.dest, m.up.Swap(0), m.down.Swap(0))
+}
+
+// close flushes the meter and stops flushing it periodically.
+func (m *accountMeter) close() {
+	m.closeOnce.Do(func() {
+		a := m.accounting
+		a.metersMutex.Lock()
+		delete(a.meters, m)
+		a.metersMutex.Unlock()
+		m.flush()
+	})
+}
+
+type accountedConn struct {
+	net.Conn
+	meter *accountMeter
+}
+
+func (c *accountedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.meter.download(n)
+	return n, err
+}
+
+func (c *accountedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.meter.upload(n)
+	return n, err
+}
+
+func (c *accountedConn) Close() error {
+	err := c.Conn.Close()
+	c.meter.close()
+	return err
+}
+
+func (c *accountedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+type accountedReadWriteCloser struct {
+	io.ReadWriteCloser
+	meter *accountMeter
+}
+
+func (c *accountedReadWriteCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.meter.download(n)
+	return n, err
+}
+
+func (c *accountedReadWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.meter.upload(n)
+	return n, err
+}
+
+func (c *accountedReadWriteCloser) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.meter.close()
+	return err
+}
+
+func (c *accountedReadWriteCloser) CloseWrite() error {
+	return closeWrite(c.ReadWriteCloser)
+}
+
+type accountedReadCloser struct {
+	io.ReadCloser
+	meter  *accountMeter
+	upload bool
+}
+
+func (c *accountedReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if c.upload {
+		c.meter.upload(n)
+	} else {
+		c.meter.download(n)
+	}
+	return n, err
+}
+
+func (c *accountedReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.meter.close()
+	return err
+}
@@ -0,0 +1,51 @@
+package wiretunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestAccountingConn(t *testing.T) {
+	a, err := NewAccounting(&AccountingConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	c, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(peer, peer)
+	ac := a.conn(c, "alice", "example.com:443")
+
+	buf := make([]byte, 4)
+	if _, err := ac.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ac, buf); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := a.Usage()["alice"]; ok {
+		t.Errorf("usage counted before a flush: %+v", u.Total)
+	}
+
+	// relays in progress are added periodically
+	a.flush()
+	if got := a.Usage()["alice"].Destinations["example.com"]; got != (Usage{Upload: 4, Download: 4}) {
+		t.Errorf("got %+v after a flush, want 4 bytes each way", got)
+	}
+
+	if _, err := ac.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ac, buf); err != nil {
+		t.Fatal(err)
+	}
+	ac.Close()
+	if got := a.Usage()["alice"].Total; got != (Usage{Upload: 8, Download: 8}) {
+		t.Errorf("got %+v after close, want 8 bytes each way", got)
+	}
+	if len(a.meters) != 0 {
+		t.Errorf("%d meters left after close", len(a.meters))
+	}
+}
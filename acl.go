@@ -0,0 +1,61 @@
+package wiretunnel
+
+import (
+	"log"
+	"net"
+)
+
+// clientAllowed reports whether the client IP may use the proxy: it must not be in
+// the deny list and, unless the allow list is empty, it must be in the allow list.
+func clientAllowed(ip net.IP, allowList, denyList []*net.IPNet) bool {
+	if ip == nil {
+		return len(allowList) == 0 && len(denyList) == 0
+	}
+	if containsIP(denyList, ip) {
+		return false
+	}
+	return len(allowList) == 0 || containsIP(allowList, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a TCP or UDP address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return net.ParseIP(remoteIP(addr.String()))
+	}
+}
+
+// aclListener closes the connections of the clients which are not allowed.
+type aclListener struct {
+	net.Listener
+	server    string
+	allowList []*net.IPNet
+	denyList  []*net.IPNet
+}
+
+func (l *aclListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if clientAllowed(addrIP(c.RemoteAddr()), l.allowList, l.denyList) {
+			return c, nil
+		}
+		log.Printf("%s: WARNING: rejected connection from %s", l.server, c.RemoteAddr())
+		c.Close()
+	}
+}
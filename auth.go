@@ -0,0 +1,66 @@
+package wiretunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+type userContextKey struct{}
+
+// User returns the identity of the authenticated proxy client, it is set in the
+// context of the requests handled by HTTPServer.
+func User(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userContextKey{}).(string)
+	return user, ok
+}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// certIdentity returns the user identity of the verified client certificate of the
+// connection: the subject common name, or else the first email, DNS or URI SAN.
+func certIdentity(cs *tls.ConnectionState) (string, bool) {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	cert := cs.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName, true
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0], true
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], true
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String(), true
+	}
+	return "", false
+}
+
+// setClientCAs enables client certificate authentication with the CA certificates of
+// the PEM file, certificates are required unless password authentication is available.
+func setClientCAs(cfg *tls.Config, caFile string, required bool) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("TLS: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("TLS: no CA certificate found in " + caFile)
+	}
+
+	cfg.ClientCAs = pool
+	if required {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
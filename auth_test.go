@@ -0,0 +1,138 @@
+package wiretunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/client")
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+		ok   bool
+	}{
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, EmailAddresses: []string{"bob@example.com"}}, "alice", true},
+		{"email", &x509.Certificate{EmailAddresses: []string{"bob@example.com"}, DNSNames: []string{"client.example.com"}}, "bob@example.com", true},
+		{"dns", &x509.Certificate{DNSNames: []string{"client.example.com"}, URIs: []*url.URL{spiffe}}, "client.example.com", true},
+		{"uri", &x509.Certificate{URIs: []*url.URL{spiffe}}, "spiffe://example.com/client", true},
+		{"no identity", &x509.Certificate{}, "", false},
+	}
+
+	for _, tt := range tests {
+		user, ok := certIdentity(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}})
+		if user != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %q, %t, want %q, %t", tt.name, user, ok, tt.want, tt.ok)
+		}
+	}
+
+	// certificates not verified are not identities
+	cs := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}}}
+	if user, ok := certIdentity(cs); ok {
+		t.Errorf("unverified certificate authenticated as %q", user)
+	}
+	if _, ok := certIdentity(nil); ok {
+		t.Error("connection without TLS authenticated")
+	}
+}
+
+func TestHTTPClientCert(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	other := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "mallory"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// the password is an alternative to the certificate
+	s := &HTTPServer{Username: "user", Password: "secret", ClientCAFile: caFile}
+	cfg := &tls.Config{Certificates: []tls.Certificate{server.tlsCertificate()}}
+	if err := setClientCAs(cfg, caFile, s.authSchemes() == 0); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("got client auth %v with a password, want certificates if given", cfg.ClientAuth)
+	}
+	proxy := newTestTLSProxy(t, s, cfg)
+
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		status int
+	}{
+		{name: "without certificate", status: http.StatusProxyAuthRequired},
+		{name: "with certificate", certs: []tls.Certificate{client.tlsCertificate()}, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := newHTTPSProxyClient(t, proxy, roots, tt.certs...).Get(upstream.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	// certificates of another CA are rejected in the handshake, the client is forced to
+	// send it as it only sends certificates of the CAs requested by the server
+	c := newHTTPSProxyClient(t, proxy, roots)
+	c.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert := other.tlsCertificate()
+		return &cert, nil
+	}
+	if resp, err := c.Get(upstream.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("certificate of an unknown CA accepted with status %d", resp.StatusCode)
+	}
+
+	cfg = &tls.Config{}
+	if err := setClientCAs(cfg, caFile, true); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("got client auth %v without a password, want certificates required", cfg.ClientAuth)
+	}
+	if err := setClientCAs(cfg, filepath.Join(t.TempDir(), "missing.pem"), true); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
@@ -0,0 +1,157 @@
+package wiretunnel
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	defaultMaxAuthFailures = 5
+	defaultAuthBackOffFrom = 3
+	defaultAuthBackOff     = time.Second
+	defaultAuthBanDuration = 15 * time.Minute
+	maxAuthBanDuration     = 24 * time.Hour
+
+	// authClientTTL is the time the failures of a client are remembered after its
+	// last failure or the end of its ban.
+	authClientTTL = time.Hour
+)
+
+// AuthLimiter protects the proxies against brute-force attacks: from BackOffFrom
+// consecutive failed authentications on, every failure blocks the client IP for an
+// exponentially growing back-off, and MaxFailures consecutive failures ban it for
+// BanDuration, doubled for every ban. It may be shared by several servers.
+type AuthLimiter struct {
+	// MaxFailures is the number of failures before a ban, default 5.
+	MaxFailures int
+	// BackOffFrom is the number of failures before the client is blocked for the first
+	// time, default 3, so that a mistyped password is not blocked.
+	BackOffFrom int
+	// BackOff is the time a client is blocked after BackOffFrom failures, default 1s.
+	BackOff time.Duration
+	// BanDuration is the duration of the first ban, default 15m, at most 24h.
+	BanDuration time.Duration
+
+	once    sync.Once
+	mutex   sync.Mutex
+	clients *cache.Cache
+}
+
+type authClient struct {
+	failures     int
+	bans         int
+	blockedUntil time.Time
+}
+
+func (l *AuthLimiter) init() {
+	l.once.Do(func() {
+		if l.MaxFailures <= 0 {
+			l.MaxFailures = defaultMaxAuthFailures
+		}
+		if l.BackOffFrom <= 0 {
+			l.BackOffFrom = defaultAuthBackOffFrom
+		}
+		if l.BackOff <= 0 {
+			l.BackOff = defaultAuthBackOff
+		}
+		if l.BanDuration <= 0 {
+			l.BanDuration = defaultAuthBanDuration
+		}
+		l.clients = cache.New(authClientTTL, 10*time.Minute)
+	})
+}
+
+// blocked returns the remaining time the client IP is blocked for.
+func (l *AuthLimiter) blocked(ip string) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.init()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	c, ok := l.clients.Get(ip)
+	if !ok {
+		return 0, false
+	}
+	remaining := time.Until(c.(*authClient).blockedUntil)
+	return remaining, remaining > 0
+}
+
+// fail records a failed authentication of the client IP and returns the duration of
+// its ban if it is banned.
+func (l *AuthLimiter) fail(ip string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.init()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	c := new(authClient)
+	if v, ok := l.clients.Get(ip); ok {
+		c = v.(*authClient)
+	}
+
+	var ban time.Duration
+	c.failures++
+	if c.failures >= l.MaxFailures {
+		ban = doubled(l.BanDuration, c.bans, maxAuthBanDuration)
+		c.failures = 0
+		c.bans++
+		c.blockedUntil = time.Now().Add(ban)
+	} else if c.failures >= l.BackOffFrom {
+		c.blockedUntil = time.Now().Add(doubled(l.BackOff, c.failures-l.BackOffFrom, maxAuthBanDuration))
+	}
+
+	l.clients.Set(ip, c, max(time.Until(c.blockedUntil), 0)+authClientTTL)
+	return ban
+}
+
+// succeed forgets the failures of the client IP.
+func (l *AuthLimiter) succeed(ip string) {
+	if l == nil {
+		return
+	}
+	l.init()
+
+	l.mutex.Lock()
+	l.clients.Delete(ip)
+	l.mutex.Unlock()
+}
+
+// doubled returns d doubled n times, at most limit.
+func doubled(d time.Duration, n int, limit time.Duration) time.Duration {
+	for ; n > 0 && d < limit; n-- {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// authFailed logs the failed authentication of the user and records it in the limiter.
+func authFailed(l *AuthLimiter, server, ip, user string) {
+	log.Printf("%s: WARNING: authentication failed for user %q from %s", server, user, ip)
+	if ban := l.fail(ip); ban > 0 {
+		log.Printf("%s: WARNING: banned %s for %s after %d failed authentications", server, ip, ban, l.MaxFailures)
+	}
+}
+
+// authBlocked logs the rejection of a client blocked after failed authentications.
+func authBlocked(server, ip string, remaining time.Duration) {
+	log.Printf("%s: WARNING: rejected %s blocked for %s after failed authentications", server, ip, remaining.Round(time.Second))
+}
+
+// remoteIP returns the IP of the remote address.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,53 @@
+package wiretunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	l := &AuthLimiter{MaxFailures: 5, BackOffFrom: 3, BackOff: time.Minute, BanDuration: time.Hour}
+
+	for i := 1; i <= 2; i++ {
+		if ban := l.fail("192.0.2.1"); ban != 0 {
+			t.Fatalf("banned after %d failures", i)
+		}
+		if _, blocked := l.blocked("192.0.2.1"); blocked {
+			t.Fatalf("blocked after %d failures, want a block from 3 failures", i)
+		}
+	}
+
+	l.fail("192.0.2.1")
+	remaining, blocked := l.blocked("192.0.2.1")
+	if !blocked || remaining > time.Minute || remaining < time.Minute-time.Second {
+		t.Fatalf("blocked %v for %s after 3 failures, want 1m", blocked, remaining)
+	}
+	l.fail("192.0.2.1")
+	if remaining, _ := l.blocked("192.0.2.1"); remaining < 2*time.Minute-time.Second {
+		t.Fatalf("blocked for %s after 4 failures, want 2m", remaining)
+	}
+
+	if ban := l.fail("192.0.2.1"); ban != time.Hour {
+		t.Fatalf("banned for %s after 5 failures, want 1h", ban)
+	}
+
+	if _, blocked := l.blocked("192.0.2.2"); blocked {
+		t.Error("other client blocked")
+	}
+
+	l.succeed("192.0.2.1")
+	if _, blocked := l.blocked("192.0.2.1"); blocked {
+		t.Error("client blocked after a success")
+	}
+}
+
+func TestAuthLimiterDefaults(t *testing.T) {
+	l := new(AuthLimiter)
+	l.fail("192.0.2.1")
+	if _, blocked := l.blocked("192.0.2.1"); blocked {
+		t.Error("blocked after the first failure")
+	}
+	if l.BackOffFrom != defaultAuthBackOffFrom || l.MaxFailures != defaultMaxAuthFailures {
+		t.Errorf("got BackOffFrom %d and MaxFailures %d, want the defaults", l.BackOffFrom, l.MaxFailures)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 )
 
 const VERSION = "1.2.2"
@@ -14,15 +16,93 @@ var (
 	httpAddr string
 	httpUser string
 	httpPass string
+	httpAuth string
+	httpTLS  bool
+	httpCert string
+	httpKey  string
+	httpCA   string
+
+	httpAllow  string
+	httpDeny   string
+	httpNoAuth string
+
+	httpTokens string
+	httpSecret string
+	genToken   string
+
+	httpMaxIdle     int
+	httpMaxConns    int
+	httpIdleTimeout time.Duration
+	httpRespTimeout time.Duration
+	httpTLSTimeout  time.Duration
+	httpStatsIntvl  time.Duration
+
+	httpErrFormat string
+	httpErrTmpl   string
+	httpForwarded string
+	httpReqHdrs   string
+	httpRespHdrs  string
+
+	pacFile   bool
+	wpadFile  bool
+	pacSOCKS5 bool
 
 	socks5Addr string
 	socks5User string
 	socks5Pass string
+	socks5TLS  bool
+	socks5Cert string
+	socks5Key  string
+	socks5CA   string
+
+	socks5Allow  string
+	socks5Deny   string
+	socks5NoAuth string
+
+	reverseAddr     string
+	reverseRoutes   string
+	reverseTLS      bool
+	reverseCert     string
+	reverseKey      string
+	reverseInsecure bool
+	reverseKeepHost bool
+	reverseAllow    string
+	reverseDeny     string
+
+	authMaxFail int
+	authBan     time.Duration
+
+	rateGlobal string
+	rateIP     string
+	rateUser   string
+	rateUsers  string
+	rateFile   string
+
+	acctFile   string
+	acctIntvl  time.Duration
+	quota      string
+	userQuotas string
 
 	bypassList string
 	localDNS   bool
+	dnsServer  string
+	splitDNS   string
+	hostsList  string
+	hostsFile  string
+	minTTL     time.Duration
+	maxTTL     time.Duration
+	cacheFile  string
+	prefetch   bool
+	serveStale time.Duration
+	ipFamily   string
+	probeList  string
+	probeIntvl time.Duration
+	statsIntvl time.Duration
+	noWait     bool
 	enableLog  bool
 
+	attemptDelay time.Duration
+
 	showVersion bool
 )
 
@@ -43,6 +123,126 @@ func configParse() error {
 		httpPass = os.Getenv("HTTP_PASS")
 	}
 
+	if !httpTLS {
+		httpTLS = os.Getenv("HTTP_TLS") == "true"
+	}
+
+	if httpCert == "" {
+		httpCert = os.Getenv("HTTP_TLS_CERT")
+	}
+
+	if httpKey == "" {
+		httpKey = os.Getenv("HTTP_TLS_KEY")
+	}
+
+	if httpCA == "" {
+		httpCA = os.Getenv("HTTP_CLIENT_CA")
+	}
+
+	if httpAuth == "" {
+		httpAuth = os.Getenv("HTTP_AUTH")
+	}
+
+	if httpAllow == "" {
+		httpAllow = os.Getenv("HTTP_ALLOW")
+	}
+
+	if httpDeny == "" {
+		httpDeny = os.Getenv("HTTP_DENY")
+	}
+
+	if httpNoAuth == "" {
+		httpNoAuth = os.Getenv("HTTP_NO_AUTH")
+	}
+
+	if httpTokens == "" {
+		httpTokens = os.Getenv("HTTP_BEARER_TOKENS")
+	}
+
+	if httpSecret == "" {
+		httpSecret = os.Getenv("HTTP_BEARER_SECRET")
+	}
+
+	if httpMaxIdle == 0 {
+		n, err := parseIntEnv("HTTP_MAX_IDLE_CONNS")
+		if err != nil {
+			return err
+		}
+		httpMaxIdle = n
+	}
+
+	if httpMaxConns == 0 {
+		n, err := parseIntEnv("HTTP_MAX_CONNS_PER_HOST")
+		if err != nil {
+			return err
+		}
+		httpMaxConns = n
+	}
+
+	if httpIdleTimeout == 0 {
+		d, err := parseDurationEnv("HTTP_IDLE_TIMEOUT")
+		if err != nil {
+			return err
+		}
+		httpIdleTimeout = d
+	}
+
+	if httpRespTimeout == 0 {
+		d, err := parseDurationEnv("HTTP_RESPONSE_HEADER_TIMEOUT")
+		if err != nil {
+			return err
+		}
+		httpRespTimeout = d
+	}
+
+	if httpTLSTimeout == 0 {
+		d, err := parseDurationEnv("HTTP_TLS_HANDSHAKE_TIMEOUT")
+		if err != nil {
+			return err
+		}
+		httpTLSTimeout = d
+	}
+
+	if httpStatsIntvl == 0 {
+		d, err := parseDurationEnv("HTTP_STATS_INTERVAL")
+		if err != nil {
+			return err
+		}
+		httpStatsIntvl = d
+	}
+
+	if httpErrFormat == "" {
+		httpErrFormat = os.Getenv("HTTP_ERROR_FORMAT")
+	}
+
+	if httpErrTmpl == "" {
+		httpErrTmpl = os.Getenv("HTTP_ERROR_TEMPLATE")
+	}
+
+	if httpForwarded == "" {
+		httpForwarded = os.Getenv("HTTP_FORWARDED")
+	}
+
+	if httpReqHdrs == "" {
+		httpReqHdrs = os.Getenv("HTTP_REQUEST_HEADERS")
+	}
+
+	if httpRespHdrs == "" {
+		httpRespHdrs = os.Getenv("HTTP_RESPONSE_HEADERS")
+	}
+
+	if !pacFile {
+		pacFile = os.Getenv("PAC") == "true"
+	}
+
+	if !wpadFile {
+		wpadFile = os.Getenv("WPAD") == "true"
+	}
+
+	if !pacSOCKS5 {
+		pacSOCKS5 = os.Getenv("PAC_SOCKS5") == "true"
+	}
+
 	if socks5Addr == "" {
 		socks5Addr = os.Getenv("SOCKS5_ADDR")
 	}
@@ -55,6 +255,126 @@ func configParse() error {
 		socks5Pass = os.Getenv("SOCKS5_PASS")
 	}
 
+	if !socks5TLS {
+		socks5TLS = os.Getenv("SOCKS5_TLS") == "true"
+	}
+
+	if socks5Cert == "" {
+		socks5Cert = os.Getenv("SOCKS5_TLS_CERT")
+	}
+
+	if socks5Key == "" {
+		socks5Key = os.Getenv("SOCKS5_TLS_KEY")
+	}
+
+	if socks5CA == "" {
+		socks5CA = os.Getenv("SOCKS5_CLIENT_CA")
+	}
+
+	if socks5Allow == "" {
+		socks5Allow = os.Getenv("SOCKS5_ALLOW")
+	}
+
+	if socks5Deny == "" {
+		socks5Deny = os.Getenv("SOCKS5_DENY")
+	}
+
+	if socks5NoAuth == "" {
+		socks5NoAuth = os.Getenv("SOCKS5_NO_AUTH")
+	}
+
+	if reverseAddr == "" {
+		reverseAddr = os.Getenv("REVERSE_ADDR")
+	}
+
+	if reverseRoutes == "" {
+		reverseRoutes = os.Getenv("REVERSE_ROUTES")
+	}
+
+	if !reverseTLS {
+		reverseTLS = os.Getenv("REVERSE_TLS") == "true"
+	}
+
+	if reverseCert == "" {
+		reverseCert = os.Getenv("REVERSE_TLS_CERT")
+	}
+
+	if reverseKey == "" {
+		reverseKey = os.Getenv("REVERSE_TLS_KEY")
+	}
+
+	if !reverseInsecure {
+		reverseInsecure = os.Getenv("REVERSE_INSECURE") == "true"
+	}
+
+	if !reverseKeepHost {
+		reverseKeepHost = os.Getenv("REVERSE_KEEP_HOST") == "true"
+	}
+
+	if reverseAllow == "" {
+		reverseAllow = os.Getenv("REVERSE_ALLOW")
+	}
+
+	if reverseDeny == "" {
+		reverseDeny = os.Getenv("REVERSE_DENY")
+	}
+
+	if authMaxFail == 0 {
+		n, err := parseIntEnv("AUTH_MAX_FAILURES")
+		if err != nil {
+			return err
+		}
+		authMaxFail = n
+	}
+
+	if authBan == 0 {
+		d, err := parseDurationEnv("AUTH_BAN_DURATION")
+		if err != nil {
+			return err
+		}
+		authBan = d
+	}
+
+	if rateGlobal == "" {
+		rateGlobal = os.Getenv("RATE_LIMIT")
+	}
+
+	if rateIP == "" {
+		rateIP = os.Getenv("RATE_LIMIT_IP")
+	}
+
+	if rateUser == "" {
+		rateUser = os.Getenv("RATE_LIMIT_USER")
+	}
+
+	if rateUsers == "" {
+		rateUsers = os.Getenv("RATE_LIMIT_USERS")
+	}
+
+	if rateFile == "" {
+		rateFile = os.Getenv("RATE_LIMIT_FILE")
+	}
+
+	if acctFile == "" {
+		acctFile = os.Getenv("ACCOUNTING_FILE")
+	}
+
+	if acctIntvl == 0 {
+		d, err := parseDurationEnv("ACCOUNTING_SAVE_INTERVAL")
+		if err != nil {
+			return err
+		}
+		acctIntvl = d
+	}
+
+	if quota == "" {
+		quota = os.Getenv("QUOTA")
+	}
+
+	if userQuotas == "" {
+		userQuotas = os.Getenv("USER_QUOTAS")
+	}
+
 	if bypassList == "" {
 		bypassList = os.Getenv("BYPASS_LIST")
 	}
@@ -63,6 +383,90 @@ func configParse() error {
 		localDNS = os.Getenv("LOCAL_DNS") == "true"
 	}
 
+	if dnsServer == "" {
+		dnsServer = os.Getenv("DNS_SERVER")
+	}
+
+	if splitDNS == "" {
+		splitDNS = os.Getenv("SPLIT_DNS")
+	}
+
+	if hostsList == "" {
+		hostsList = os.Getenv("HOSTS")
+	}
+
+	if hostsFile == "" {
+		hostsFile = os.Getenv("HOSTS_FILE")
+	}
+
+	if minTTL == 0 {
+		d, err := parseDurationEnv("MIN_TTL")
+		if err != nil {
+			return err
+		}
+		minTTL = d
+	}
+
+	if maxTTL == 0 {
+		d, err := parseDurationEnv("MAX_TTL")
+		if err != nil {
+			return err
+		}
+		maxTTL = d
+	}
+
+	if cacheFile == "" {
+		cacheFile = os.Getenv("DNS_CACHE_FILE")
+	}
+
+	if !prefetch {
+		prefetch = os.Getenv("DNS_PREFETCH") == "true"
+	}
+
+	if serveStale == 0 {
+		d, err := parseDurationEnv("SERVE_STALE")
+		if err != nil {
+			return err
+		}
+		serveStale = d
+	}
+
+	if attemptDelay == 0 {
+		d, err := parseDurationEnv("ATTEMPT_DELAY")
+		if err != nil {
+			return err
+		}
+		attemptDelay = d
+	}
+
+	if ipFamily == "" {
+		ipFamily = os.Getenv("IP_FAMILY")
+	}
+
+	if probeList == "" {
+		probeList = os.Getenv("PROBE_TARGETS")
+	}
+
+	if probeIntvl == 0 {
+		d, err := parseDurationEnv("PROBE_INTERVAL")
+		if err != nil {
+			return err
+		}
+		probeIntvl = d
+	}
+
+	if statsIntvl == 0 {
+		d, err := parseDurationEnv("STATS_INTERVAL")
+		if err != nil {
+			return err
+		}
+		statsIntvl = d
+	}
+
+	if !noWait {
+		noWait = os.Getenv("NO_WAIT") == "true"
+	}
+
 	if !enableLog {
 		enableLog = os.Getenv("ENABLE_LOG") == "true"
 	}
@@ -75,13 +479,65 @@ func configParse() error {
 		httpAddr = ":8080"
 	}
 
+	if (httpCert == "") != (httpKey == "") {
+		return errors.New("both HTTP TLS certificate and key are required")
+	}
+
+	if (socks5Cert == "") != (socks5Key == "") {
+		return errors.New("both SOCKS5 TLS certificate and key are required")
+	}
+
 	if socks5Addr == "" {
 		socks5Addr = ":1080"
 	}
 
+	if (reverseCert == "") != (reverseKey == "") {
+		return errors.New("both reverse proxy TLS certificate and key are required")
+	}
+
+	if reverseAddr != "" && reverseRoutes == "" {
+		return errors.New("reverse proxy routes are required")
+	}
+
+	if (quota != "" || userQuotas != "") && acctFile == "" {
+		return errors.New("accounting file is required for quotas, they would reset on restart")
+	}
+
+	if dnsServer == "" {
+		if localDNS {
+			dnsServer = "local"
+		} else {
+			dnsServer = "tunnel"
+		}
+	}
+
 	return nil
 }
 
+func parseDurationEnv(key string) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+func parseIntEnv(key string) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
 func printVersion() {
 	fmt.Printf("WireTunnel v%s\n", VERSION)
 }
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/DevonTM/wiretunnel"
 )
@@ -14,17 +21,92 @@ func init() {
 	flag.StringVar(&httpAddr, "haddr", "", "HTTP server `address`, set '0' to disable, default ':8080'\n$HTTP_ADDR")
 	flag.StringVar(&httpUser, "huser", "", "HTTP proxy `username`\n$HTTP_USER")
 	flag.StringVar(&httpPass, "hpass", "", "HTTP proxy `password`\n$HTTP_PASS")
+	flag.StringVar(&httpAuth, "hauth", "", "HTTP proxy authentication `schemes`: basic, digest and bearer separated by commas\n$HTTP_AUTH")
+	flag.StringVar(&httpAllow, "hallow", "", "Client `IPs` allowed to use the HTTP proxy separated by commas, default all\n$HTTP_ALLOW")
+	flag.StringVar(&httpDeny, "hdeny", "", "Client `IPs` denied from using the HTTP proxy separated by commas\n$HTTP_DENY")
+	flag.StringVar(&httpNoAuth, "hnoauth", "", "Client `IPs` allowed to use the HTTP proxy without authentication separated by commas\n$HTTP_NO_AUTH")
+	flag.StringVar(&httpTokens, "htokens", "", "HTTP proxy static bearer `tokens` in the form token=user separated by commas\n$HTTP_BEARER_TOKENS")
+	flag.StringVar(&httpSecret, "hsecret", "", "HTTP proxy bearer token signing `secret`\n$HTTP_BEARER_SECRET")
+	flag.StringVar(&genToken, "gentoken", "", "Print a bearer token signed with the secret for `user[:duration]` and exit, default duration '24h'")
+	flag.BoolVar(&httpTLS, "htls", false, "Serve the HTTP proxy over TLS, with a self-signed certificate if none is set\n$HTTP_TLS")
+	flag.StringVar(&httpCert, "hcert", "", "HTTP proxy TLS certificate file `path`\n$HTTP_TLS_CERT")
+	flag.StringVar(&httpKey, "hkey", "", "HTTP proxy TLS key file `path`\n$HTTP_TLS_KEY")
+	flag.StringVar(&httpCA, "hca", "", "HTTP proxy client CA certificate file `path` for client certificate authentication\n$HTTP_CLIENT_CA")
+	flag.IntVar(&httpMaxIdle, "hidle", 0, "Idle upstream connections kept per host by the HTTP proxy, default 100\n$HTTP_MAX_IDLE_CONNS")
+	flag.IntVar(&httpMaxConns, "hmaxconns", 0, "Maximum upstream connections per host of the HTTP proxy, default unlimited\n$HTTP_MAX_CONNS_PER_HOST")
+	flag.DurationVar(&httpIdleTimeout, "hidlet", 0, "Idle upstream connection timeout `duration` of the HTTP proxy, default '90s'\n$HTTP_IDLE_TIMEOUT")
+	flag.DurationVar(&httpRespTimeout, "hrespt", 0, "Upstream response header timeout `duration` of the HTTP proxy, default unlimited\n$HTTP_RESPONSE_HEADER_TIMEOUT")
+	flag.DurationVar(&httpTLSTimeout, "htlst", 0, "Upstream TLS handshake timeout `duration` of the HTTP proxy, default '10s'\n$HTTP_TLS_HANDSHAKE_TIMEOUT")
+	flag.DurationVar(&httpStatsIntvl, "hstats", 0, "Log the upstream connection pool usage of the HTTP proxy every `duration`\n$HTTP_STATS_INTERVAL")
+	flag.StringVar(&httpErrFormat, "herr", "", "Error page `format` of the HTTP and reverse proxies: text, html or json, default 'text'\n$HTTP_ERROR_FORMAT")
+	flag.StringVar(&httpErrTmpl, "herrt", "", "Error page html/template file `path` for the html format\n$HTTP_ERROR_TEMPLATE")
+	flag.StringVar(&httpForwarded, "hfwd", "", "Forwarded header `policy`: none, add, strip or anonymous, default 'none'\n$HTTP_FORWARDED")
+	flag.StringVar(&httpReqHdrs, "hreq", "", "HTTP proxy request header `rules` in the form -Name or Name:value separated by commas\n$HTTP_REQUEST_HEADERS")
+	flag.StringVar(&httpRespHdrs, "hres", "", "HTTP proxy response header `rules` in the form -Name or Name:value separated by commas\n$HTTP_RESPONSE_HEADERS")
+	flag.BoolVar(&pacFile, "pac", false, "Serve a proxy auto-config file at /proxy.pac on the HTTP server\n$PAC")
+	flag.BoolVar(&wpadFile, "wpad", false, "Also serve the proxy auto-config file at /wpad.dat\n$WPAD")
+	flag.BoolVar(&pacSOCKS5, "pacs", false, "Point the proxy auto-config file at the SOCKS5 proxy first\n$PAC_SOCKS5")
 	flag.StringVar(&socks5Addr, "saddr", "", "SOCKS5 server `address`, set '0' to disable, default ':1080'\n$SOCKS5_ADDR")
 	flag.StringVar(&socks5User, "suser", "", "SOCKS5 proxy `username`\n$SOCKS5_USER")
 	flag.StringVar(&socks5Pass, "spass", "", "SOCKS5 proxy `password`\n$SOCKS5_PASS")
+	flag.StringVar(&socks5Allow, "sallow", "", "Client `IPs` allowed to use the SOCKS5 proxy separated by commas, default all\n$SOCKS5_ALLOW")
+	flag.StringVar(&socks5Deny, "sdeny", "", "Client `IPs` denied from using the SOCKS5 proxy separated by commas\n$SOCKS5_DENY")
+	flag.StringVar(&socks5NoAuth, "snoauth", "", "Client `IPs` allowed to use the SOCKS5 proxy without authentication separated by commas\n$SOCKS5_NO_AUTH")
+	flag.BoolVar(&socks5TLS, "stls", false, "Wrap the SOCKS5 proxy in TLS, with a self-signed certificate if none is set\n$SOCKS5_TLS")
+	flag.StringVar(&socks5Cert, "scert", "", "SOCKS5 proxy TLS certificate file `path`\n$SOCKS5_TLS_CERT")
+	flag.StringVar(&socks5Key, "skey", "", "SOCKS5 proxy TLS key file `path`\n$SOCKS5_TLS_KEY")
+	flag.StringVar(&socks5CA, "sca", "", "SOCKS5 proxy client CA certificate file `path` for client certificate authentication\n$SOCKS5_CLIENT_CA")
+	flag.StringVar(&reverseAddr, "raddr", "", "Reverse proxy server `address`, disabled if empty\n$REVERSE_ADDR")
+	flag.StringVar(&reverseRoutes, "rroutes", "", "Reverse proxy `routes` in the form [host]/prefix=URL separated by commas\n$REVERSE_ROUTES")
+	flag.BoolVar(&reverseTLS, "rtls", false, "Serve the reverse proxy over TLS, with a self-signed certificate if none is set\n$REVERSE_TLS")
+	flag.StringVar(&reverseCert, "rcert", "", "Reverse proxy TLS certificate file `path`\n$REVERSE_TLS_CERT")
+	flag.StringVar(&reverseKey, "rkey", "", "Reverse proxy TLS key file `path`\n$REVERSE_TLS_KEY")
+	flag.BoolVar(&reverseInsecure, "rinsecure", false, "Skip the verification of HTTPS upstream certificates\n$REVERSE_INSECURE")
+	flag.BoolVar(&reverseKeepHost, "rhost", false, "Forward the client Host header instead of the upstream host\n$REVERSE_KEEP_HOST")
+	flag.StringVar(&reverseAllow, "rallow", "", "Client `IPs` allowed to use the reverse proxy separated by commas, default all\n$REVERSE_ALLOW")
+	flag.StringVar(&reverseDeny, "rdeny", "", "Client `IPs` denied from using the reverse proxy separated by commas\n$REVERSE_DENY")
+	flag.IntVar(&authMaxFail, "authmax", 0, "Failed authentications from an IP before it is banned, default 5, -1 to disable\n$AUTH_MAX_FAILURES")
+	flag.DurationVar(&authBan, "authban", 0, "First ban `duration` of an IP, doubled for every ban, default '15m'\n$AUTH_BAN_DURATION")
+	flag.StringVar(&rateGlobal, "bw", "", "Bandwidth limit of all the clients in bytes per second in the form `upload/download`\n$RATE_LIMIT")
+	flag.StringVar(&rateIP, "bwip", "", "Bandwidth limit of every client IP in the form `upload/download`\n$RATE_LIMIT_IP")
+	flag.StringVar(&rateUser, "bwuser", "", "Bandwidth limit of every user in the form `upload/download`\n$RATE_LIMIT_USER")
+	flag.StringVar(&rateUsers, "bwusers", "", "Bandwidth limits of some users in the form `user=upload/download` separated by commas\n$RATE_LIMIT_USERS")
+	flag.StringVar(&rateFile, "bwfile", "", "Bandwidth limits file `path`, reloaded when it changes\n$RATE_LIMIT_FILE")
+	flag.StringVar(&acctFile, "acct", "", "Data transfer accounting file `path` per user and destination\n$ACCOUNTING_FILE")
+	flag.DurationVar(&acctIntvl, "accti", 0, "Accounting file save interval `duration`, default '1m'\n$ACCOUNTING_SAVE_INTERVAL")
+	flag.StringVar(&quota, "quota", "", "Data transfer quota of every user in bytes in the form `daily/monthly`\n$QUOTA")
+	flag.StringVar(&userQuotas, "quotas", "", "Data transfer quotas of some users in the form `user=daily/monthly` separated by commas\n$USER_QUOTAS")
 	flag.StringVar(&bypassList, "bl", "", "Bypass list of `IPs` separated by commas\n$BYPASS_LIST")
-	flag.BoolVar(&localDNS, "ldns", false, "Resolve address locally\n$LOCAL_DNS")
+	flag.BoolVar(&localDNS, "ldns", false, "Resolve address locally, same as '-dns local'\n$LOCAL_DNS")
+	flag.StringVar(&dnsServer, "dns", "", "DNS `upstream` in the form tunnel|local[:server], default 'tunnel'\n$DNS_SERVER")
+	flag.StringVar(&splitDNS, "sdns", "", "Split DNS `entries` in the form domain=upstream separated by commas\n$SPLIT_DNS")
+	flag.StringVar(&hostsList, "hosts", "", "Static host entries `host=IP` separated by commas\n$HOSTS")
+	flag.StringVar(&hostsFile, "hf", "", "Hosts file `path` in /etc/hosts format\n$HOSTS_FILE")
+	flag.DurationVar(&minTTL, "minttl", 0, "Minimum DNS cache `duration`, default '1s'\n$MIN_TTL")
+	flag.DurationVar(&maxTTL, "maxttl", 0, "Maximum DNS cache `duration`, default '24h'\n$MAX_TTL")
+	flag.StringVar(&cacheFile, "dcache", "", "DNS cache file `path` to persist the cache across restarts\n$DNS_CACHE_FILE")
+	flag.BoolVar(&prefetch, "prefetch", false, "Refresh frequently used DNS entries before they expire\n$DNS_PREFETCH")
+	flag.DurationVar(&serveStale, "stale", 0, "Serve expired DNS entries up to `duration` when upstream is unreachable\n$SERVE_STALE")
+	flag.DurationVar(&attemptDelay, "delay", 0, "Delay `duration` between concurrent connection attempts, default '250ms'\n$ATTEMPT_DELAY")
+	flag.StringVar(&ipFamily, "family", "", "Address family `preference`: prefer-ipv6, prefer-ipv4, ipv4-only or ipv6-only, default 'prefer-ipv6'\n$IP_FAMILY")
+	flag.StringVar(&probeList, "probe", "", "Connectivity probe `addresses` in the form IP:port separated by commas\n$PROBE_TARGETS")
+	flag.DurationVar(&probeIntvl, "pint", 0, "Connectivity probe interval `duration`, default '1m'\n$PROBE_INTERVAL")
+	flag.DurationVar(&statsIntvl, "stats", 0, "Log the tunnel connectivity and the data transferred per user every `duration`\n$STATS_INTERVAL")
+	flag.BoolVar(&noWait, "nowait", false, "Start without waiting for the tunnel, proxies report errors until it is ready\n$NO_WAIT")
 	flag.BoolVar(&enableLog, "log", false, "Enable logging to stdout\n$ENABLE_LOG")
 	flag.BoolVar(&showVersion, "v", false, "Print version and exit")
 	flag.Parse()
 }
 
 func main() {
+	if genToken != "" {
+		err := printToken()
+		if err != nil {
+			log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+		}
+		return
+	}
+
 	printVersion()
 	if showVersion {
 		return
@@ -40,25 +122,213 @@ func main() {
 		log.Fatal(fmt.Errorf("WireGuard: ERROR: %w", err))
 	}
 
-	r, err := wiretunnel.NewResolver(d, localDNS)
+	upstream, err := wiretunnel.ParseDNSUpstream(dnsServer)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	domains, err := wiretunnel.ParseSplitDNS(splitDNS)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	hosts, err := wiretunnel.ParseHostsList(hostsList)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	family, err := wiretunnel.ParseFamilyPreference(ipFamily)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	var probeTargets []string
+	if probeList != "" {
+		probeTargets = strings.Split(probeList, ",")
+	}
+
+	r, err := wiretunnel.NewResolver(d, &wiretunnel.ResolverConfig{
+		Upstream:   upstream,
+		Domains:    domains,
+		Hosts:      hosts,
+		HostsFile:  hostsFile,
+		MinTTL:     minTTL,
+		MaxTTL:     maxTTL,
+		CacheFile:  cacheFile,
+		Prefetch:   prefetch,
+		ServeStale: serveStale,
+
+		Family:        family,
+		ProbeTargets:  probeTargets,
+		ProbeInterval: probeIntvl,
+		NoWait:        noWait,
+	})
 	if err != nil {
 		log.Fatal(fmt.Errorf("Resolver: ERROR: %w", err))
 	}
 
+	accounting, err := newAccounting()
+	if err != nil {
+		log.Fatal(fmt.Errorf("Accounting: ERROR: %w", err))
+	}
+
+	rateLimiter, err := newRateLimiter()
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		err := r.Close()
+		if err != nil {
+			log.Printf("Resolver: ERROR: %v", err)
+		}
+		if accounting != nil {
+			err = accounting.Close()
+			if err != nil {
+				log.Printf("Accounting: ERROR: %v", err)
+			}
+		}
+		if rateLimiter != nil {
+			rateLimiter.Close()
+		}
+		os.Exit(0)
+	}()
+
+	if statsIntvl > 0 {
+		go func() {
+			for range time.Tick(statsIntvl) {
+				ip4, ip6 := r.Connectivity()
+				log.Printf("Resolver: INFO: tunnel ready: %t, IPv4 reachable: %t, IPv6 reachable: %t", r.Ready(), ip4, ip6)
+				logUsage(accounting)
+			}
+		}()
+	}
+
 	b := wiretunnel.ParseBypassList(bypassList)
 
+	var authLimiter *wiretunnel.AuthLimiter
+	if authMaxFail >= 0 {
+		authLimiter = &wiretunnel.AuthLimiter{
+			MaxFailures: authMaxFail,
+			BanDuration: authBan,
+		}
+	}
+
+	authSchemes, err := wiretunnel.ParseAuthSchemes(httpAuth)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	bearerTokens, err := wiretunnel.ParseBearerTokens(httpTokens)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	forwarded, err := wiretunnel.ParseForwardedPolicy(httpForwarded)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	reqHeaders, err := wiretunnel.ParseHeaderRules(httpReqHdrs)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	respHeaders, err := wiretunnel.ParseHeaderRules(httpRespHdrs)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+
+	httpClients, err := parseClientLists(httpAllow, httpDeny, httpNoAuth)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: HTTP proxy %w", err))
+	}
+
+	socks5Clients, err := parseClientLists(socks5Allow, socks5Deny, socks5NoAuth)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: SOCKS5 proxy %w", err))
+	}
+
+	reverseClients, err := parseClientLists(reverseAllow, reverseDeny, "")
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: reverse proxy %w", err))
+	}
+
+	routes, err := wiretunnel.ParseReverseRoutes(reverseRoutes)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Config: ERROR: %w", err))
+	}
+	for i := range routes {
+		routes[i].KeepHost = reverseKeepHost
+	}
+
 	var wg sync.WaitGroup
 
 	if httpAddr != "0" {
 		wg.Add(1)
 		go func() {
 			httpServer := &wiretunnel.HTTPServer{
-				Address:    httpAddr,
-				Username:   httpUser,
-				Password:   httpPass,
+				Address:  httpAddr,
+				Username: httpUser,
+				Password: httpPass,
+
+				AuthLimiter:  authLimiter,
+				AuthSchemes:  authSchemes,
+				BearerTokens: bearerTokens,
+				BearerSecret: []byte(httpSecret),
+
+				AllowList:  httpClients.allow,
+				DenyList:   httpClients.deny,
+				NoAuthList: httpClients.noAuth,
+
+				RateLimiter: rateLimiter,
+				Accounting:  accounting,
+
+				TLS:         httpTLS,
+				TLSCertFile: httpCert,
+				TLSKeyFile:  httpKey,
+
+				ClientCAFile: httpCA,
+
+				EnableLog: enableLog,
+
 				Dialer:     d,
 				BypassList: b,
 				Resolver:   r,
+
+				AttemptDelay: attemptDelay,
+
+				Transport: &wiretunnel.TransportConfig{
+					MaxIdleConnsPerHost:   httpMaxIdle,
+					MaxConnsPerHost:       httpMaxConns,
+					IdleConnTimeout:       httpIdleTimeout,
+					ResponseHeaderTimeout: httpRespTimeout,
+					TLSHandshakeTimeout:   httpTLSTimeout,
+				},
+
+				ErrorFormat:   httpErrFormat,
+				ErrorTemplate: httpErrTmpl,
+
+				Forwarded:       forwarded,
+				RequestHeaders:  reqHeaders,
+				ResponseHeaders: respHeaders,
+
+				PAC:  pacFile || wpadFile,
+				WPAD: wpadFile,
+			}
+			// browsers support neither SOCKS5 authentication nor TLS
+			if pacSOCKS5 && socks5Addr != "0" && socks5User == "" && !socks5TLS && socks5Cert == "" && socks5CA == "" {
+				httpServer.PACSOCKS5Address = socks5Addr
+			}
+			if httpStatsIntvl > 0 {
+				go func() {
+					for range time.Tick(httpStatsIntvl) {
+						log.Println("HTTP proxy server: INFO: upstream connections:", httpServer.TransportStats())
+					}
+				}()
 			}
 			log.Println("HTTP proxy server: INFO: listening on", httpAddr)
 			err := httpServer.ListenAndServe()
@@ -73,13 +343,30 @@ func main() {
 		wg.Add(1)
 		go func() {
 			socks5Server := &wiretunnel.SOCKS5Server{
-				Address:    socks5Addr,
-				Username:   socks5User,
-				Password:   socks5Pass,
+				Address:  socks5Addr,
+				Username: socks5User,
+				Password: socks5Pass,
+
+				AuthLimiter: authLimiter,
+
+				AllowList:  socks5Clients.allow,
+				DenyList:   socks5Clients.deny,
+				NoAuthList: socks5Clients.noAuth,
+
+				RateLimiter: rateLimiter,
+				Accounting:  accounting,
+
+				TLS:          socks5TLS,
+				TLSCertFile:  socks5Cert,
+				TLSKeyFile:   socks5Key,
+				ClientCAFile: socks5CA,
+
 				EnableLog:  enableLog,
 				Dialer:     d,
 				BypassList: b,
 				Resolver:   r,
+
+				AttemptDelay: attemptDelay,
 			}
 			log.Println("SOCKS5 proxy server: INFO: listening on", socks5Addr)
 			err := socks5Server.ListenAndServe()
@@ -90,5 +377,166 @@ func main() {
 		}()
 	}
 
+	if reverseAddr != "" {
+		wg.Add(1)
+		go func() {
+			reverseServer := &wiretunnel.ReverseProxyServer{
+				Address: reverseAddr,
+				Routes:  routes,
+
+				TLS:         reverseTLS,
+				TLSCertFile: reverseCert,
+				TLSKeyFile:  reverseKey,
+
+				InsecureSkipVerify: reverseInsecure,
+
+				AllowList: reverseClients.allow,
+				DenyList:  reverseClients.deny,
+
+				ErrorFormat:   httpErrFormat,
+				ErrorTemplate: httpErrTmpl,
+
+				EnableLog: enableLog,
+
+				Dialer:     d,
+				BypassList: b,
+				Resolver:   r,
+
+				AttemptDelay: attemptDelay,
+			}
+			log.Println("Reverse proxy server: INFO: listening on", reverseAddr)
+			err := reverseServer.ListenAndServe()
+			if err != nil {
+				log.Printf("Reverse proxy server: ERROR: %v", err)
+			}
+			wg.Done()
+		}()
+	}
+
 	wg.Wait()
 }
+
+// printToken prints a bearer token for the -gentoken user, valid for the optional duration.
+func printToken() error {
+	if httpSecret == "" {
+		httpSecret = os.Getenv("HTTP_BEARER_SECRET")
+	}
+	if httpSecret == "" {
+		return errors.New("bearer token secret is required")
+	}
+
+	user, ttl, ok := strings.Cut(genToken, ":")
+	validity := 24 * time.Hour
+	if ok {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return err
+		}
+		validity = d
+	}
+
+	fmt.Println(wiretunnel.NewBearerToken([]byte(httpSecret), user, time.Now().Add(validity)))
+	return nil
+}
+
+// clientLists are the client allow, deny and no authentication lists of a server.
+type clientLists struct {
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	noAuth []*net.IPNet
+}
+
+// parseClientLists parses the client lists of a server, failing on invalid entries.
+func parseClientLists(allow, deny, noAuth string) (*clientLists, error) {
+	var l clientLists
+	var err error
+
+	l.allow, err = wiretunnel.ParseIPList(allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow list: %w", err)
+	}
+	l.deny, err = wiretunnel.ParseIPList(deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny list: %w", err)
+	}
+	l.noAuth, err = wiretunnel.ParseIPList(noAuth)
+	if err != nil {
+		return nil, fmt.Errorf("no authentication list: %w", err)
+	}
+
+	return &l, nil
+}
+
+// newRateLimiter returns the rate limiter of the bandwidth flags, or nil if none is set.
+func newRateLimiter() (*wiretunnel.RateLimiter, error) {
+	if rateGlobal == "" && rateIP == "" && rateUser == "" && rateUsers == "" && rateFile == "" {
+		return nil, nil
+	}
+
+	var limits wiretunnel.RateLimits
+	for _, v := range []struct {
+		rate  *wiretunnel.Rate
+		value string
+	}{
+		{&limits.Global, rateGlobal},
+		{&limits.PerIP, rateIP},
+		{&limits.PerUser, rateUser},
+	} {
+		if v.value == "" {
+			continue
+		}
+		rate, err := wiretunnel.ParseRate(v.value)
+		if err != nil {
+			return nil, err
+		}
+		*v.rate = rate
+	}
+
+	users, err := wiretunnel.ParseUserRates(rateUsers)
+	if err != nil {
+		return nil, err
+	}
+	limits.Users = users
+
+	return wiretunnel.NewRateLimiter(limits, rateFile)
+}
+
+// logUsage logs the data transferred by every user today, this month and in total.
+func logUsage(accounting *wiretunnel.Accounting) {
+	if accounting == nil {
+		return
+	}
+	for user, u := range accounting.Usage() {
+		log.Printf("Accounting: INFO: user %q: today %d/%d, this month %d/%d, total %d/%d bytes uploaded/downloaded",
+			user, u.Daily.Upload, u.Daily.Download, u.Monthly.Upload, u.Monthly.Download, u.Total.Upload, u.Total.Download)
+	}
+}
+
+// newAccounting returns the accounting of the accounting and quota flags, or nil if none
+// is set.
+func newAccounting() (*wiretunnel.Accounting, error) {
+	if acctFile == "" && quota == "" && userQuotas == "" {
+		return nil, nil
+	}
+
+	cfg := &wiretunnel.AccountingConfig{
+		File:         acctFile,
+		SaveInterval: acctIntvl,
+	}
+
+	if quota != "" {
+		q, err := wiretunnel.ParseQuota(quota)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Quota = q
+	}
+
+	quotas, err := wiretunnel.ParseUserQuotas(userQuotas)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Quotas = quotas
+
+	return wiretunnel.NewAccounting(cfg)
+}
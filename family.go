@@ -0,0 +1,97 @@
+package wiretunnel
+
+import (
+	"fmt"
+	"net"
+)
+
+// FamilyPreference controls the address families the resolver queries and the order
+// in which the addresses of a host are dialed.
+type FamilyPreference int
+
+const (
+	// PreferIPv6 queries both families and dials IPv6 addresses first.
+	PreferIPv6 FamilyPreference = iota
+	// PreferIPv4 queries both families and dials IPv4 addresses first.
+	PreferIPv4
+	// IPv4Only queries and dials IPv4 addresses only.
+	IPv4Only
+	// IPv6Only queries and dials IPv6 addresses only.
+	IPv6Only
+)
+
+// ParseFamilyPreference parses one of prefer-ipv6, prefer-ipv4, ipv4-only or ipv6-only,
+// an empty string is PreferIPv6.
+func ParseFamilyPreference(s string) (FamilyPreference, error) {
+	switch s {
+	case "", "prefer-ipv6":
+		return PreferIPv6, nil
+	case "prefer-ipv4":
+		return PreferIPv4, nil
+	case "ipv4-only":
+		return IPv4Only, nil
+	case "ipv6-only":
+		return IPv6Only, nil
+	default:
+		return 0, fmt.Errorf("invalid address family preference %q", s)
+	}
+}
+
+func (f FamilyPreference) String() string {
+	switch f {
+	case PreferIPv6:
+		return "prefer-ipv6"
+	case PreferIPv4:
+		return "prefer-ipv4"
+	case IPv4Only:
+		return "ipv4-only"
+	case IPv6Only:
+		return "ipv6-only"
+	default:
+		return fmt.Sprintf("FamilyPreference(%d)", int(f))
+	}
+}
+
+// allows reports whether addresses of the given IP family may be used.
+func (f FamilyPreference) allows(ip net.IP) bool {
+	switch f {
+	case IPv4Only:
+		return ip.To4() != nil
+	case IPv6Only:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// network returns the network of the families allowed, ip, ip4 or ip6.
+func (f FamilyPreference) network() string {
+	switch f {
+	case IPv4Only:
+		return "ip4"
+	case IPv6Only:
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// order filters the IPs by family and interleaves them starting with the preferred family.
+func (f FamilyPreference) order(ips []net.IP) []net.IP {
+	var ip4, ip6 []net.IP
+	for _, ip := range ips {
+		if !f.allows(ip) {
+			continue
+		}
+		if ip.To4() != nil {
+			ip4 = append(ip4, ip)
+		} else {
+			ip6 = append(ip6, ip)
+		}
+	}
+
+	if f == PreferIPv4 {
+		return combineIPs(ip4, ip6)
+	}
+	return combineIPs(ip6, ip4)
+}
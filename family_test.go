@@ -0,0 +1,49 @@
+package wiretunnel
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestFamilyPreferenceOrder(t *testing.T) {
+	var ips []net.IP
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2"} {
+		ips = append(ips, net.ParseIP(s))
+	}
+
+	tests := []struct {
+		family FamilyPreference
+		want   []string
+	}{
+		{family: PreferIPv6, want: []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}},
+		{family: PreferIPv4, want: []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"}},
+		{family: IPv4Only, want: []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		{family: IPv6Only, want: []string{"2001:db8::1", "2001:db8::2"}},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, ip := range tt.family.order(ips) {
+			got = append(got, ip.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestParseFamilyPreference(t *testing.T) {
+	for _, f := range []FamilyPreference{PreferIPv6, PreferIPv4, IPv4Only, IPv6Only} {
+		got, err := ParseFamilyPreference(f.String())
+		if err != nil || got != f {
+			t.Errorf("ParseFamilyPreference(%q) = %v, %v", f.String(), got, err)
+		}
+	}
+	if f, err := ParseFamilyPreference(""); err != nil || f != PreferIPv6 {
+		t.Errorf("got %v, %v for the default, want prefer-ipv6", f, err)
+	}
+	if _, err := ParseFamilyPreference("ipv4"); err == nil {
+		t.Error("invalid preference accepted")
+	}
+}
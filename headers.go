@@ -0,0 +1,161 @@
+package wiretunnel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// viaPseudonym identifies the proxy in Via headers instead of its host name.
+const viaPseudonym = "wiretunnel"
+
+// ForwardedPolicy controls the headers identifying the client and the proxy in the
+// requests forwarded by the HTTP proxy.
+type ForwardedPolicy int
+
+const (
+	// ForwardedNone forwards the headers sent by the client unchanged.
+	ForwardedNone ForwardedPolicy = iota
+	// ForwardedAdd appends the client to the Forwarded (RFC 7239) and X-Forwarded-For
+	// headers and the proxy to the Via header.
+	ForwardedAdd
+	// ForwardedStrip removes the Forwarded, X-Forwarded-* and Via headers sent by the client.
+	ForwardedStrip
+	// ForwardedAnonymous removes every header which may reveal the client or the proxy.
+	ForwardedAnonymous
+)
+
+// forwardedHeaders identify the client or the proxies a request went through.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"Via",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// anonymousHeaders may reveal the client in addition to forwardedHeaders.
+var anonymousHeaders = []string{
+	"Client-Ip",
+	"From",
+	"True-Client-Ip",
+	"X-Client-Ip",
+	"X-Originating-Ip",
+}
+
+// ParseForwardedPolicy parses one of none, add, strip or anonymous, an empty string
+// is ForwardedNone.
+func ParseForwardedPolicy(s string) (ForwardedPolicy, error) {
+	switch s {
+	case "", "none":
+		return ForwardedNone, nil
+	case "add":
+		return ForwardedAdd, nil
+	case "strip":
+		return ForwardedStrip, nil
+	case "anonymous":
+		return ForwardedAnonymous, nil
+	default:
+		return 0, fmt.Errorf("invalid forwarded header policy %q", s)
+	}
+}
+
+func (p ForwardedPolicy) String() string {
+	switch p {
+	case ForwardedNone:
+		return "none"
+	case ForwardedAdd:
+		return "add"
+	case ForwardedStrip:
+		return "strip"
+	case ForwardedAnonymous:
+		return "anonymous"
+	default:
+		return fmt.Sprintf("ForwardedPolicy(%d)", int(p))
+	}
+}
+
+// applyRequest updates the identification headers of the request out, forwarded on
+// behalf of the client request r.
+func (p ForwardedPolicy) applyRequest(out http.Header, r *http.Request) {
+	switch p {
+	case ForwardedAdd:
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+
+		appendHeader(out, "Forwarded", fmt.Sprintf("for=%s;host=%s;proto=%s",
+			forwardedNode(clientIP), strconv.Quote(r.Host), proto))
+		appendHeader(out, "X-Forwarded-For", clientIP)
+		appendHeader(out, "Via", viaValue(r.ProtoMajor, r.ProtoMinor))
+	case ForwardedStrip:
+		delHeaders(out, forwardedHeaders)
+	case ForwardedAnonymous:
+		delHeaders(out, forwardedHeaders)
+		delHeaders(out, anonymousHeaders)
+	}
+}
+
+// applyResponse updates the identification headers of the response of upstream.
+func (p ForwardedPolicy) applyResponse(header http.Header, resp *http.Response) {
+	switch p {
+	case ForwardedAdd:
+		appendHeader(header, "Via", viaValue(resp.ProtoMajor, resp.ProtoMinor))
+	case ForwardedAnonymous:
+		header.Del("Via")
+	}
+}
+
+// forwardedNode formats an IP address as a node of the Forwarded header, IPv6 addresses
+// are enclosed in brackets and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return strconv.Quote("[" + ip + "]")
+	}
+	return ip
+}
+
+func viaValue(major, minor int) string {
+	if major >= 2 {
+		return strconv.Itoa(major) + " " + viaPseudonym
+	}
+	return fmt.Sprintf("%d.%d %s", major, minor, viaPseudonym)
+}
+
+func appendHeader(header http.Header, key, value string) {
+	if prior := header.Values(key); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	header.Set(key, value)
+}
+
+func delHeaders(header http.Header, keys []string) {
+	for _, k := range keys {
+		header.Del(k)
+	}
+}
+
+// HeaderRules removes and sets headers of the requests or responses forwarded by the
+// HTTP proxy, headers are removed before the others are set.
+type HeaderRules struct {
+	Remove []string
+	Set    http.Header
+}
+
+func (h *HeaderRules) apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	delHeaders(header, h.Remove)
+	for k, v := range h.Set {
+		header[k] = append([]string(nil), v...)
+	}
+}
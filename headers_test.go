@@ -0,0 +1,172 @@
+package wiretunnel
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedPolicyRequest(t *testing.T) {
+	clientHeaders := http.Header{
+		"Forwarded":       {"for=198.51.100.1"},
+		"X-Forwarded-For": {"198.51.100.1"},
+		"Via":             {"1.1 other"},
+		"X-Real-Ip":       {"198.51.100.1"},
+		"True-Client-Ip":  {"198.51.100.1"},
+		"User-Agent":      {"test"},
+	}
+
+	tests := []struct {
+		policy     ForwardedPolicy
+		remoteAddr string
+		tls        bool
+		want       http.Header
+	}{
+		{
+			policy:     ForwardedNone,
+			remoteAddr: "192.0.2.1:1234",
+			want:       clientHeaders,
+		},
+		{
+			policy:     ForwardedAdd,
+			remoteAddr: "192.0.2.1:1234",
+			want: http.Header{
+				"Forwarded":       {`for=198.51.100.1, for=192.0.2.1;host="example.com";proto=http`},
+				"X-Forwarded-For": {"198.51.100.1, 192.0.2.1"},
+				"Via":             {"1.1 other, 1.1 wiretunnel"},
+				"X-Real-Ip":       {"198.51.100.1"},
+				"True-Client-Ip":  {"198.51.100.1"},
+				"User-Agent":      {"test"},
+			},
+		},
+		{
+			policy:     ForwardedAdd,
+			remoteAddr: "[2001:db8::1]:1234",
+			tls:        true,
+			want: http.Header{
+				"Forwarded":       {`for=198.51.100.1, for="[2001:db8::1]";host="example.com";proto=https`},
+				"X-Forwarded-For": {"198.51.100.1, 2001:db8::1"},
+				"Via":             {"1.1 other, 1.1 wiretunnel"},
+				"X-Real-Ip":       {"198.51.100.1"},
+				"True-Client-Ip":  {"198.51.100.1"},
+				"User-Agent":      {"test"},
+			},
+		},
+		{
+			policy:     ForwardedStrip,
+			remoteAddr: "192.0.2.1:1234",
+			want: http.Header{
+				"True-Client-Ip": {"198.51.100.1"},
+				"User-Agent":     {"test"},
+			},
+		},
+		{
+			policy:     ForwardedAnonymous,
+			remoteAddr: "192.0.2.1:1234",
+			want:       http.Header{"User-Agent": {"test"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			out := clientHeaders.Clone()
+			tt.policy.applyRequest(out, r)
+
+			if len(out) != len(tt.want) {
+				t.Errorf("got headers %v, want %v", out, tt.want)
+			}
+			for k, want := range tt.want {
+				if got := out.Get(k); got != want[0] {
+					t.Errorf("got %s %q, want %q", k, got, want[0])
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedPolicyResponse(t *testing.T) {
+	tests := []struct {
+		policy ForwardedPolicy
+		proto  int
+		want   string
+	}{
+		{policy: ForwardedNone, proto: 1, want: "1.1 upstream"},
+		{policy: ForwardedAdd, proto: 1, want: "1.1 upstream, 1.1 wiretunnel"},
+		{policy: ForwardedAdd, proto: 2, want: "1.1 upstream, 2 wiretunnel"},
+		{policy: ForwardedStrip, proto: 1, want: "1.1 upstream"},
+		{policy: ForwardedAnonymous, proto: 1, want: ""},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{ProtoMajor: tt.proto, ProtoMinor: 1, Header: http.Header{"Via": {"1.1 upstream"}}}
+		if tt.proto == 2 {
+			resp.ProtoMinor = 0
+		}
+		tt.policy.applyResponse(resp.Header, resp)
+		if got := resp.Header.Get("Via"); got != tt.want {
+			t.Errorf("%s over HTTP/%d: got Via %q, want %q", tt.policy, tt.proto, got, tt.want)
+		}
+	}
+}
+
+func TestHTTPForwardedHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream")
+		w.Header().Set("X-Internal", "secret")
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	defer upstream.Close()
+
+	rules, err := ParseHeaderRules("-User-Agent,X-Proxy:wiretunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	respRules, err := ParseHeaderRules("-X-Internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newProxyClient(t, newTestHTTPProxy(t, &HTTPServer{
+		Forwarded:       ForwardedAdd,
+		RequestHeaders:  rules,
+		ResponseHeaders: respRules,
+	}))
+
+	req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	req.Header.Set("User-Agent", "client")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var got http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if v := got.Get("X-Forwarded-For"); v != "198.51.100.1, 127.0.0.1" {
+		t.Errorf("upstream got X-Forwarded-For %q", v)
+	}
+	if v := got.Get("Via"); v != "1.1 wiretunnel" {
+		t.Errorf("upstream got Via %q", v)
+	}
+	if v := got.Get("User-Agent"); v != "" {
+		t.Errorf("removed header User-Agent %q forwarded", v)
+	}
+	if v := got.Get("X-Proxy"); v != "wiretunnel" {
+		t.Errorf("upstream got X-Proxy %q, want wiretunnel", v)
+	}
+	if v := resp.Header.Get("Via"); v != "1.1 wiretunnel" {
+		t.Errorf("got response Via %q", v)
+	}
+	if v := resp.Header.Get("X-Internal"); v != "" {
+		t.Errorf("removed response header X-Internal %q forwarded", v)
+	}
+}
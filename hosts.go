@@ -0,0 +1,188 @@
+package wiretunnel
+
+import (
+	"bufio"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostsCheckInterval is the minimum interval between checks of the hosts file for changes.
+const hostsCheckInterval = 5 * time.Second
+
+type hostsTable struct {
+	mutex   sync.RWMutex
+	static  map[string][]string
+	file    map[string][]string
+	path    string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+func newHostsTable(static map[string][]string, path string) (*hostsTable, error) {
+	h := &hostsTable{
+		static: make(map[string][]string, len(static)),
+		path:   path,
+	}
+
+	for name, addrs := range static {
+		h.static[normalizeHost(name)] = addrs
+	}
+
+	if path != "" {
+		err := h.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// lookup returns the addresses for the given host, static entries take precedence over the hosts file.
+func (h *hostsTable) lookup(host string) ([]string, bool) {
+	h.reload()
+
+	host = normalizeHost(host)
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if addrs, ok := h.static[host]; ok {
+		return addrs, true
+	}
+	if addrs, ok := h.file[host]; ok {
+		return addrs, true
+	}
+
+	// match wildcard entries from the most specific to the least specific
+	for name := host; ; {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+		if addrs, ok := h.static["*."+name]; ok {
+			return addrs, true
+		}
+		if addrs, ok := h.file["*."+name]; ok {
+			return addrs, true
+		}
+	}
+
+	return nil, false
+}
+
+// entries returns all the entries of the table, static entries take precedence over the
+// hosts file.
+func (h *hostsTable) entries() map[string][]string {
+	h.reload()
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	entries := make(map[string][]string, len(h.static)+len(h.file))
+	maps.Copy(entries, h.file)
+	maps.Copy(entries, h.static)
+	return entries
+}
+
+// reload reloads the hosts file if it has changed since the last load.
+func (h *hostsTable) reload() {
+	if h.path == "" {
+		return
+	}
+
+	h.mutex.Lock()
+	if time.Since(h.checked) < hostsCheckInterval {
+		h.mutex.Unlock()
+		return
+	}
+	h.checked = time.Now()
+	h.mutex.Unlock()
+
+	info, err := os.Stat(h.path)
+	if err != nil {
+		log.Printf("Resolver: WARNING: failed to check hosts file: %v", err)
+		return
+	}
+
+	h.mutex.RLock()
+	changed := !info.ModTime().Equal(h.modTime) || info.Size() != h.size
+	h.mutex.RUnlock()
+	if !changed {
+		return
+	}
+
+	err = h.load()
+	if err != nil {
+		log.Printf("Resolver: WARNING: failed to reload hosts file: %v", err)
+		return
+	}
+	log.Printf("Resolver: INFO: reloaded hosts file %s", h.path)
+}
+
+func (h *hostsTable) load() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	entries, err := parseHostsFile(f)
+	if err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	h.file = entries
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	h.checked = time.Now()
+	h.mutex.Unlock()
+	return nil
+}
+
+// parseHostsFile parses the content of a file in the /etc/hosts format.
+func parseHostsFile(f *os.File) (map[string][]string, error) {
+	entries := make(map[string][]string)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			name = normalizeHost(name)
+			entries[name] = append(entries[name], ip.String())
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
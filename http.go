@@ -2,13 +2,17 @@ package wiretunnel
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/botanica-consulting/wiredialer"
+	"github.com/patrickmn/go-cache"
 )
 
 type HTTPServer struct {
@@ -16,45 +20,201 @@ type HTTPServer struct {
 	Username string
 	Password string
 
+	// AuthSchemes are the accepted authentication schemes, by default Basic if Username
+	// is set and Bearer if BearerTokens or BearerSecret is.
+	AuthSchemes AuthScheme
+
+	// BearerTokens maps static bearer tokens to users, BearerSecret verifies the
+	// tokens made by NewBearerToken.
+	BearerTokens map[string]string
+	BearerSecret []byte
+
+	// AuthLimiter blocks the clients failing to authenticate, failures are logged
+	// regardless.
+	AuthLimiter *AuthLimiter
+
+	// AllowList restricts the clients to these networks if not empty, DenyList rejects
+	// the clients of these networks and NoAuthList lets them skip authentication.
+	AllowList  []*net.IPNet
+	DenyList   []*net.IPNet
+	NoAuthList []*net.IPNet
+
+	// RateLimiter limits the bandwidth of the relays per client IP, user and globally.
+	RateLimiter *RateLimiter
+
+	// Accounting counts the bytes relayed per user and destination, and rejects the
+	// requests of the users exceeding their quota.
+	Accounting *Accounting
+
+	// TLS makes the listener serve HTTPS proxy clients, with a self-signed certificate
+	// if TLSCertFile is empty.
+	TLS         bool
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ClientCAFile enables TLS client certificate authentication with the CA certificates
+	// of the file, clients are authenticated as the identity of their certificate.
+	// Certificates are required unless another authentication scheme is enabled.
+	ClientCAFile string
+
+	// EnableLog logs the errors of the connections to upstream.
+	EnableLog bool
+
 	Dialer     *wiredialer.WireDialer
 	BypassList []*net.IPNet
 	Resolver   Resolver
 
+	// AttemptDelay is the delay between concurrent connection attempts to the
+	// resolved addresses, default DefaultAttemptDelay.
+	AttemptDelay time.Duration
+
+	// Forwarded controls the Forwarded, X-Forwarded-For and Via headers of the
+	// forwarded requests, RequestHeaders and ResponseHeaders remove or set other ones.
+	Forwarded       ForwardedPolicy
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
+
+	// Transport controls the pool of connections of the forwarded requests.
+	Transport *TransportConfig
+
+	// ErrorFormat is the format of the error responses: text (default), html or json.
+	// ErrorTemplate is an html/template file replacing the default html error page.
+	ErrorFormat   string
+	ErrorTemplate string
+
+	// PAC serves a proxy auto-config file at /proxy.pac to direct requests, and at
+	// /wpad.dat for Web Proxy Auto-Discovery if WPAD is set. The file points at
+	// the SOCKS5 proxy first if PACSOCKS5Address is set.
+	PAC              bool
+	WPAD             bool
+	PACSOCKS5Address string
+
 	dial      dialFunc
+	lookup    func(host string) ([]string, error)
 	transport *http.Transport
+	pool      transportPool
+	errorPage *errorPage
+	digestKey []byte
+
+	// digestCounts is the last nonce count of every Digest nonce in use.
+	digestCounts *cache.Cache
+	digestMutex  sync.Mutex
 }
 
 // ListenAndServe listens on the s.Address and serves HTTP requests.
 func (s *HTTPServer) ListenAndServe() error {
+	var err error
+	s.errorPage, err = newErrorPage(s.ErrorFormat, s.ErrorTemplate)
+	if err != nil {
+		return err
+	}
+
+	if s.AuthSchemes&(AuthBasic|AuthDigest) != 0 && s.Username == "" {
+		return errors.New("username is required for basic and digest authentication")
+	}
+	if s.AuthSchemes&AuthBearer != 0 && len(s.BearerTokens) == 0 && len(s.BearerSecret) == 0 {
+		return errors.New("bearer tokens or secret are required for bearer authentication")
+	}
+	s.digestKey = newDigestKey()
+	s.digestCounts = cache.New(digestNonceLifetime, digestNonceLifetime)
+
 	s.dial = dialFilter(s.Dialer.DialContext, s.BypassList)
+	s.lookup = s.Dialer.LookupHost
 	if s.Resolver != nil {
-		s.dial = dialWithResolver(s.dial, s.Resolver)
+		s.dial = dialWithResolver(s.dial, s.Resolver, s.AttemptDelay)
+		s.lookup = func(host string) ([]string, error) {
+			return s.Resolver.LookupHost(context.Background(), host)
+		}
 	}
 
-	s.transport = &http.Transport{
-		DialContext:         s.dial,
-		DisableCompression:  true,
-		MaxIdleConnsPerHost: 100,
-	}
+	s.transport = newTransport(s.dial, s.Transport, &s.pool)
+
+	// HTTP/2 is served over TLS and, with prior knowledge, over cleartext (h2c)
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
 
 	server := &http.Server{
-		Addr:    s.Address,
-		Handler: s,
+		Addr:      s.Address,
+		Handler:   s,
+		Protocols: protocols,
+	}
+
+	if s.TLS || s.TLSCertFile != "" || s.ClientCAFile != "" {
+		tlsConfig, err := newTLSConfig(s.TLSCertFile, s.TLSKeyFile, s.Address)
+		if err != nil {
+			return err
+		}
+		if s.ClientCAFile != "" {
+			err = setClientCAs(tlsConfig, s.ClientCAFile, s.authSchemes() == 0 && len(s.NoAuthList) == 0)
+			if err != nil {
+				return err
+			}
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	l, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+	l = &aclListener{
+		Listener:  l,
+		server:    "HTTP proxy server",
+		allowList: s.AllowList,
+		denyList:  s.DenyList,
 	}
 
-	return server.ListenAndServe()
+	if server.TLSConfig != nil {
+		return server.ServeTLS(l, "", "")
+	}
+	return server.Serve(l)
 }
 
 // ServeHTTP implements the http.Handler interface.
 func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if s.Username != "" && !s.authenticate(r.Header) {
-		w.Header().Set("Proxy-Authenticate", `Basic realm="`+http.StatusText(http.StatusProxyAuthRequired)+`"`)
-		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+	// browsers fetch the PAC file without credentials
+	if s.isPACRequest(r) {
+		s.servePAC(w, r)
+		return
+	}
+
+	ip := remoteIP(r.RemoteAddr)
+	if s.authRequired() && !containsIP(s.NoAuthList, net.ParseIP(ip)) {
+		if remaining, blocked := s.AuthLimiter.blocked(ip); blocked {
+			authBlocked("HTTP proxy server", ip, remaining)
+			w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+			s.writeError(w, r, newProxyError(http.StatusTooManyRequests, "http_request_denied", "Too many failed authentications, try again later."))
+			return
+		}
+
+		user, ok := s.authenticate(r)
+		if !ok {
+			// a stale Digest nonce is not a failure, the client retries with a new one
+			stale := s.isStaleDigest(r)
+			if r.Header.Get("Proxy-Authorization") != "" && !stale {
+				authFailed(s.AuthLimiter, "HTTP proxy server", ip, user)
+			}
+			s.setAuthChallenges(w.Header(), stale)
+			s.writeError(w, r, newProxyError(http.StatusProxyAuthRequired, "http_request_denied", "Proxy authentication required."))
+			return
+		}
+		s.AuthLimiter.succeed(ip)
+		r = r.WithContext(withUser(r.Context(), user))
+	}
+
+	if user, _ := User(r.Context()); s.Accounting.checkQuota(user) != nil {
+		s.writeError(w, r, newProxyError(http.StatusForbidden, "http_request_denied", "The data transfer quota is exceeded."))
 		return
 	}
 
-	switch r.Method {
-	case http.MethodConnect:
+	switch {
+	case isConnectUDP(r):
+		s.handleConnectUDP(w, r)
+	case r.Method == http.MethodConnect && r.ProtoMajor == 2:
+		s.handleConnectH2(w, r)
+	case r.Method == http.MethodConnect:
 		s.handleConnect(w, r)
 	default:
 		s.handleOther(w, r)
@@ -66,20 +226,23 @@ var connectSuccess = []byte(" 200 Connection Established\r\n\r\n")
 func (s *HTTPServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	peer, err := s.dial(r.Context(), "tcp", r.Host)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		s.writeUpstreamError(w, r, err)
 		return
 	}
+	ip, user := rateClient(r)
+	peer = s.Accounting.conn(peer, user, r.Host)
+	peer = s.RateLimiter.conn(peer, ip, user, false)
 	defer peer.Close()
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		s.writeError(w, r, errHijack)
 		return
 	}
 
 	conn, _, err := hijacker.Hijack()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.writeError(w, r, errHijack)
 		return
 	}
 	defer conn.Close()
@@ -96,12 +259,12 @@ func (s *HTTPServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 func (s *HTTPServer) handleOther(w http.ResponseWriter, r *http.Request) {
 	laddr, err := getLocalAddr(r.Context())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		s.writeError(w, r, newProxyError(http.StatusServiceUnavailable, "proxy_internal_error", "The server is shutting down."))
 		return
 	}
 
 	if r.Host == laddr {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.writeError(w, r, newProxyError(http.StatusBadRequest, "http_request_error", "This is a proxy server, the request must be a proxy request."))
 		return
 	}
 
@@ -109,41 +272,126 @@ func (s *HTTPServer) handleOther(w http.ResponseWriter, r *http.Request) {
 	r.URL.Scheme = "http"
 	r.RequestURI = ""
 
+	reqUpType := upgradeType(r.Header)
+	teTrailers := headerContainsToken(r.Header, "Te", "trailers")
 	delHopHeaders(r.Header)
-	resp, err := s.transport.RoundTrip(r)
+	s.Forwarded.applyRequest(r.Header, r)
+	s.RequestHeaders.apply(r.Header)
+	// an empty User-Agent keeps the transport from sending its own
+	if _, ok := r.Header["User-Agent"]; !ok {
+		r.Header["User-Agent"] = nil
+	}
+	if reqUpType != "" {
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", reqUpType)
+	}
+	// the client accepts trailers, let upstream know it can send them
+	if teTrailers {
+		r.Header.Set("Te", "trailers")
+	}
+
+	ip, user := rateClient(r)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = s.Accounting.body(r.Body, user, r.Host, true)
+		r.Body = s.RateLimiter.body(r.Body, ip, user, true)
+	}
+
+	resp, err := s.transport.RoundTrip(r.WithContext(s.pool.withTrace(r.Context())))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		s.writeUpstreamError(w, r, err)
+		return
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		s.handleUpgradeResponse(w, r, resp)
 		return
 	}
 	defer resp.Body.Close()
 
 	delHopHeaders(resp.Header)
+	s.Forwarded.applyResponse(resp.Header, resp)
+	s.ResponseHeaders.apply(resp.Header)
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
 
+	// announce the trailers so they can be sent after the body
+	announcedTrailers := len(resp.Trailer)
+	if announcedTrailers > 0 {
+		trailerKeys := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			trailerKeys = append(trailerKeys, k)
+		}
+		w.Header().Set("Trailer", strings.Join(trailerKeys, ", "))
+	}
+
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	body := s.Accounting.body(resp.Body, user, r.Host, false)
+	body = s.RateLimiter.body(body, ip, user, false)
+	defer body.Close()
+	err = copyResponse(w, body, isStreaming(resp))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		// abort the connection so the client knows the response is truncated
+		panic(http.ErrAbortHandler)
+	}
+
+	if len(resp.Trailer) == announcedTrailers {
+		for k, v := range resp.Trailer {
+			w.Header()[k] = v
+		}
+	} else {
+		for k, v := range resp.Trailer {
+			w.Header()[http.TrailerPrefix+k] = v
+		}
 	}
 }
 
-func (s *HTTPServer) authenticate(header http.Header) bool {
-	authHeader := header.Get("Proxy-Authorization")
-	if authHeader == "" {
-		return false
+// TransportStats returns the usage of the pool of connections of the forwarded requests.
+func (s *HTTPServer) TransportStats() TransportStats {
+	return s.pool.stats()
+}
+
+// rateClient returns the client IP and user of the request for the rate limiter.
+func rateClient(r *http.Request) (string, string) {
+	user, _ := User(r.Context())
+	return remoteIP(r.RemoteAddr), user
+}
+
+// isStreaming reports whether the response body must be flushed to the client as it
+// arrives, which is the case for server-sent events and bodies of unknown length.
+func isStreaming(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
 	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream")
+}
 
-	encodedCreds := authHeader[6:]
-	creds, err := base64.StdEncoding.DecodeString(encodedCreds)
-	if err != nil {
-		return false
+// copyResponse copies the body to the client, flushing after every write if flush is true.
+func copyResponse(w http.ResponseWriter, body io.Reader, flush bool) error {
+	if !flush {
+		_, err := io.Copy(w, body)
+		return err
 	}
 
-	pair := strings.SplitN(string(creds), ":", 2)
-	return pair[0] == s.Username && pair[1] == s.Password
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
 }
 
 var hopHeaders = []string{
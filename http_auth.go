@@ -0,0 +1,366 @@
+package wiretunnel
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthScheme is a set of HTTP proxy authentication schemes.
+type AuthScheme int
+
+const (
+	// AuthBasic accepts Username and Password with Basic authentication (RFC 7617).
+	AuthBasic AuthScheme = 1 << iota
+	// AuthDigest accepts Username and Password with Digest authentication (RFC 7616),
+	// the password is never sent in cleartext.
+	AuthDigest
+	// AuthBearer accepts the bearer tokens of BearerTokens or signed with BearerSecret.
+	AuthBearer
+)
+
+const (
+	authRealm = "Proxy Authentication Required"
+
+	// digestNonceLifetime is the time a Digest nonce is accepted, clients retry with a
+	// new nonce afterwards without asking the user for credentials again.
+	digestNonceLifetime = 5 * time.Minute
+)
+
+// ParseAuthSchemes parses a list of basic, digest or bearer separated by commas.
+func ParseAuthSchemes(list string) (AuthScheme, error) {
+	var schemes AuthScheme
+	for _, s := range strings.Split(list, ",") {
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "":
+		case "basic":
+			schemes |= AuthBasic
+		case "digest":
+			schemes |= AuthDigest
+		case "bearer":
+			schemes |= AuthBearer
+		default:
+			return 0, fmt.Errorf("invalid authentication scheme %q", s)
+		}
+	}
+	return schemes, nil
+}
+
+// NewBearerToken returns a bearer token for the user valid until expires, signed with
+// the secret, in the form user.expiry.signature.
+func NewBearerToken(secret []byte, user string, expires time.Time) string {
+	payload := user + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(bearerSignature(secret, payload))
+}
+
+func bearerSignature(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// authSchemes returns the enabled authentication schemes, by default Basic when a
+// username is set and Bearer when tokens are.
+func (s *HTTPServer) authSchemes() AuthScheme {
+	if s.AuthSchemes != 0 {
+		return s.AuthSchemes
+	}
+
+	var schemes AuthScheme
+	if s.Username != "" {
+		schemes |= AuthBasic
+	}
+	if len(s.BearerTokens) > 0 || len(s.BearerSecret) > 0 {
+		schemes |= AuthBearer
+	}
+	return schemes
+}
+
+// authRequired reports whether clients must authenticate.
+func (s *HTTPServer) authRequired() bool {
+	return s.authSchemes() != 0 || s.ClientCAFile != ""
+}
+
+// authenticate returns the identity of the client of the request, or the user it
+// failed to authenticate as.
+func (s *HTTPServer) authenticate(r *http.Request) (string, bool) {
+	if user, ok := certIdentity(r.TLS); ok {
+		return user, true
+	}
+
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	credentials = strings.TrimSpace(credentials)
+	schemes := s.authSchemes()
+
+	switch {
+	case strings.EqualFold(scheme, "Basic") && schemes&AuthBasic != 0:
+		return s.authenticateBasic(credentials)
+	case strings.EqualFold(scheme, "Digest") && schemes&AuthDigest != 0:
+		return s.authenticateDigest(r, credentials)
+	case strings.EqualFold(scheme, "Bearer") && schemes&AuthBearer != 0:
+		return s.authenticateBearer(credentials)
+	}
+	return "", false
+}
+
+// setAuthChallenges sets a challenge for every enabled authentication scheme, stale
+// marks the Digest nonce of the request as expired.
+func (s *HTTPServer) setAuthChallenges(h http.Header, stale bool) {
+	schemes := s.authSchemes()
+	if schemes&AuthDigest != 0 {
+		nonce := s.digestNonce(time.Now())
+		staleParam := ""
+		if stale {
+			staleParam = ", stale=true"
+		}
+		// SHA-256 first as it is preferred, MD5 for older clients
+		for _, algorithm := range []string{"SHA-256", "MD5"} {
+			h.Add("Proxy-Authenticate", fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=%s, nonce=%q%s`,
+				authRealm, algorithm, nonce, staleParam))
+		}
+	}
+	if schemes&AuthBasic != 0 {
+		h.Add("Proxy-Authenticate", `Basic realm="`+authRealm+`"`)
+	}
+	if schemes&AuthBearer != 0 {
+		h.Add("Proxy-Authenticate", `Bearer realm="`+authRealm+`"`)
+	}
+}
+
+func (s *HTTPServer) authenticateBasic(credentials string) (string, bool) {
+	if s.Username == "" {
+		return "", false
+	}
+
+	creds, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", false
+	}
+
+	user, pass, ok := strings.Cut(string(creds), ":")
+	if !ok || !secureEqual(user, s.Username) || !secureEqual(pass, s.Password) {
+		return user, false
+	}
+	return user, true
+}
+
+func (s *HTTPServer) authenticateBearer(token string) (string, bool) {
+	for t, user := range s.BearerTokens {
+		if secureEqual(token, t) {
+			return user, true
+		}
+	}
+
+	if len(s.BearerSecret) == 0 {
+		return "", false
+	}
+
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload, signature := token[:i], token[i+1:]
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, bearerSignature(s.BearerSecret, payload)) {
+		return "", false
+	}
+
+	i = strings.LastIndexByte(payload, '.')
+	if i <= 0 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(payload[i+1:], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return payload[:i], false
+	}
+	return payload[:i], true
+}
+
+// authenticateDigest verifies the Digest response of the request, the nonce is
+// stateless so it is checked for its signature and age, and its count must increase
+// with every request to prevent replays.
+func (s *HTTPServer) authenticateDigest(r *http.Request, credentials string) (string, bool) {
+	params := parseAuthParams(credentials)
+	user, ok := s.verifyDigest(r, params)
+	if !ok {
+		return user, false
+	}
+	if !s.validDigestNonce(params["nonce"], time.Now()) || !s.useDigestCount(params["nonce"], params["nc"]) {
+		return user, false
+	}
+	return user, true
+}
+
+// verifyDigest verifies the Digest response computed from the credentials, regardless
+// of the age and count of the nonce.
+func (s *HTTPServer) verifyDigest(r *http.Request, params map[string]string) (string, bool) {
+	if s.Username == "" {
+		return "", false
+	}
+
+	user := params["username"]
+	if user != s.Username || params["realm"] != authRealm || params["qop"] != "auth" {
+		return user, false
+	}
+	if !s.checkDigestNonce(params["nonce"]) {
+		return user, false
+	}
+
+	uri := params["uri"]
+	if uri != r.RequestURI && uri != r.URL.RequestURI() && uri != r.Host {
+		return user, false
+	}
+
+	var h func() hash.Hash
+	algorithm := params["algorithm"]
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return user, false
+	}
+	digest := func(parts ...string) string {
+		d := h()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	ha1 := digest(s.Username, authRealm, s.Password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = digest(ha1, params["nonce"], params["cnonce"])
+	}
+	ha2 := digest(r.Method, uri)
+	expected := digest(ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2)
+
+	if !secureEqual(strings.ToLower(params["response"]), expected) {
+		return user, false
+	}
+	return s.Username, true
+}
+
+// useDigestCount records the nonce count of a verified response, a count not greater
+// than the last one of the nonce is a replay.
+func (s *HTTPServer) useDigestCount(nonce, nc string) bool {
+	count, err := strconv.ParseUint(nc, 16, 32)
+	if err != nil || count == 0 {
+		return false
+	}
+
+	s.digestMutex.Lock()
+	defer s.digestMutex.Unlock()
+
+	if last, ok := s.digestCounts.Get(nonce); ok && count <= last.(uint64) {
+		return false
+	}
+	s.digestCounts.Set(nonce, count, digestNonceLifetime)
+	return true
+}
+
+// isStaleDigest reports whether the request has a Digest response with an expired but
+// genuine nonce, or a genuine response with a nonce count already used, for instance
+// by requests sent concurrently. The client then retries with the nonce of the new
+// challenge.
+func (s *HTTPServer) isStaleDigest(r *http.Request) bool {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return false
+	}
+	params := parseAuthParams(credentials)
+	nonce := params["nonce"]
+	if !s.checkDigestNonce(nonce) {
+		return false
+	}
+	if !s.validDigestNonce(nonce, time.Now()) {
+		return true
+	}
+	// the nonce is valid, so the response failed only for its count
+	_, ok := s.verifyDigest(r, params)
+	return ok
+}
+
+// digestNonce returns a nonce made of the time and its HMAC with the server key.
+func (s *HTTPServer) digestNonce(now time.Time) string {
+	b := binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))
+	mac := hmac.New(sha256.New, s.digestKey)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+// checkDigestNonce reports whether the nonce was generated by this server.
+func (s *HTTPServer) checkDigestNonce(nonce string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.digestKey)
+	mac.Write(b[:8])
+	return hmac.Equal(b[8:], mac.Sum(nil))
+}
+
+func (s *HTTPServer) validDigestNonce(nonce string, now time.Time) bool {
+	if !s.checkDigestNonce(nonce) {
+		return false
+	}
+	b, _ := base64.RawURLEncoding.DecodeString(nonce)
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	return now.Sub(issued) < digestNonceLifetime
+}
+
+func newDigestKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// parseAuthParams parses the comma separated key=value or key="value" parameters of
+// an authorization header.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
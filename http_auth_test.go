@@ -0,0 +1,146 @@
+package wiretunnel
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func newTestAuthServer() *HTTPServer {
+	return &HTTPServer{
+		Username:     "user",
+		Password:     "secret",
+		AuthSchemes:  AuthDigest | AuthBearer,
+		BearerSecret: []byte("bearer secret"),
+		digestKey:    newDigestKey(),
+		digestCounts: cache.New(digestNonceLifetime, digestNonceLifetime),
+	}
+}
+
+func TestDigestNonce(t *testing.T) {
+	s := newTestAuthServer()
+	now := time.Now()
+	nonce := s.digestNonce(now)
+
+	if !s.validDigestNonce(nonce, now) {
+		t.Error("fresh nonce not valid")
+	}
+	if !s.validDigestNonce(nonce, now.Add(digestNonceLifetime-time.Second)) {
+		t.Error("nonce not valid before its lifetime")
+	}
+	if s.validDigestNonce(nonce, now.Add(digestNonceLifetime+time.Second)) {
+		t.Error("expired nonce valid")
+	}
+	if !s.checkDigestNonce(nonce) {
+		t.Error("expired nonce not genuine")
+	}
+
+	b, _ := base64.RawURLEncoding.DecodeString(nonce)
+	b[7]++
+	if s.checkDigestNonce(base64.RawURLEncoding.EncodeToString(b)) {
+		t.Error("nonce with a tampered time genuine")
+	}
+	if s.checkDigestNonce(nonce[:len(nonce)-2]) {
+		t.Error("truncated nonce genuine")
+	}
+	if newTestAuthServer().checkDigestNonce(nonce) {
+		t.Error("nonce of another key genuine")
+	}
+}
+
+// digestAuthorization returns the Proxy-Authorization header of a SHA-256 Digest
+// response to the nonce.
+func digestAuthorization(user, password, method, uri, nonce, nc string) string {
+	digest := func(parts ...string) string {
+		d := sha256.Sum256([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d[:])
+	}
+	ha1 := digest(user, authRealm, password)
+	ha2 := digest(method, uri)
+	response := digest(ha1, nonce, nc, "cnonce", "auth", ha2)
+	return fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=SHA-256, qop=auth, nc=%s, cnonce="cnonce", response=%q`,
+		user, authRealm, nonce, uri, nc, response)
+}
+
+func TestDigestNonceCount(t *testing.T) {
+	s := newTestAuthServer()
+	nonce := s.digestNonce(time.Now())
+
+	request := func(password, nc string) *http.Request {
+		r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		r.Header.Set("Proxy-Authorization", digestAuthorization("user", password, http.MethodConnect, "example.com:443", nonce, nc))
+		return r
+	}
+
+	tests := []struct {
+		name      string
+		password  string
+		nc        string
+		wantOK    bool
+		wantStale bool
+	}{
+		{name: "first", password: "secret", nc: "00000001", wantOK: true},
+		{name: "replayed", password: "secret", nc: "00000001", wantStale: true},
+		{name: "increased", password: "secret", nc: "00000003", wantOK: true},
+		{name: "decreased", password: "secret", nc: "00000002", wantStale: true},
+		{name: "zero", password: "secret", nc: "00000000", wantStale: true},
+		{name: "invalid", password: "secret", nc: "nc", wantStale: true},
+		{name: "wrong password", password: "guess", nc: "00000001"},
+		{name: "wrong password with a new count", password: "guess", nc: "00000004"},
+		{name: "after a wrong password", password: "secret", nc: "00000004", wantOK: true},
+	}
+
+	for _, tt := range tests {
+		r := request(tt.password, tt.nc)
+		user, ok := s.authenticate(r)
+		if ok != tt.wantOK {
+			t.Errorf("%s: got %q, %v, want %v", tt.name, user, ok, tt.wantOK)
+		}
+		if ok {
+			continue
+		}
+		if stale := s.isStaleDigest(r); stale != tt.wantStale {
+			t.Errorf("%s: got stale %v, want %v", tt.name, stale, tt.wantStale)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	s := newTestAuthServer()
+	s.BearerTokens = map[string]string{"static-token": "static"}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantUser string
+		wantOK   bool
+	}{
+		{name: "signed", token: NewBearerToken(s.BearerSecret, "alice", time.Now().Add(time.Hour)), wantUser: "alice", wantOK: true},
+		{name: "user with dots", token: NewBearerToken(s.BearerSecret, "alice.smith", time.Now().Add(time.Hour)), wantUser: "alice.smith", wantOK: true},
+		{name: "expired", token: NewBearerToken(s.BearerSecret, "alice", time.Now().Add(-time.Second)), wantUser: "alice"},
+		{name: "other secret", token: NewBearerToken([]byte("other"), "alice", time.Now().Add(time.Hour))},
+		{name: "tampered user", token: "mallory" + strings.TrimPrefix(NewBearerToken(s.BearerSecret, "alice", time.Now().Add(time.Hour)), "alice")},
+		{name: "no signature", token: "alice.4102444800"},
+		{name: "static", token: "static-token", wantUser: "static", wantOK: true},
+		{name: "empty", token: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+			r.Header.Set("Proxy-Authorization", "Bearer "+tt.token)
+			user, ok := s.authenticate(r)
+			if user != tt.wantUser || ok != tt.wantOK {
+				t.Errorf("got %q, %v, want %q, %v", user, ok, tt.wantUser, tt.wantOK)
+			}
+		})
+	}
+}
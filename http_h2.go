@@ -0,0 +1,139 @@
+package wiretunnel
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// websocketGUID is the GUID used to compute Sec-WebSocket-Accept, RFC 6455 section 1.3.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// extendedConnectProtocol returns the :protocol pseudo-header of an extended CONNECT
+// request (RFC 8441), it requires GODEBUG=http2xconnect=1.
+func extendedConnectProtocol(r *http.Request) string {
+	if r.ProtoMajor != 2 {
+		return ""
+	}
+	return r.Header.Get(":protocol")
+}
+
+// relayStream relays the HTTP/2 stream of the request with the connection: the request
+// body is the client to upstream direction and the response the other one.
+func relayStream(w http.ResponseWriter, r *http.Request, conn io.ReadWriteCloser) {
+	rc := http.NewResponseController(w)
+	err := rc.Flush()
+	if err != nil {
+		return
+	}
+
+	go func() {
+		io.Copy(conn, r.Body)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	}()
+	copyResponse(w, conn, true)
+}
+
+// handleConnectH2 handles a CONNECT request over HTTP/2, the tunnel is the request
+// stream itself as the connection cannot be hijacked.
+func (s *HTTPServer) handleConnectH2(w http.ResponseWriter, r *http.Request) {
+	switch protocol := extendedConnectProtocol(r); protocol {
+	case "":
+	case "websocket":
+		s.handleWebSocketH2(w, r)
+		return
+	default:
+		s.writeError(w, r, newProxyError(http.StatusNotImplemented, "http_request_error", fmt.Sprintf("The protocol %q is not supported.", protocol)))
+		return
+	}
+
+	peer, err := s.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		s.writeUpstreamError(w, r, err)
+		return
+	}
+	ip, user := rateClient(r)
+	peer = s.Accounting.conn(peer, user, r.Host)
+	peer = s.RateLimiter.conn(peer, ip, user, false)
+	defer peer.Close()
+
+	w.WriteHeader(http.StatusOK)
+	relayStream(w, r, peer)
+}
+
+// handleWebSocketH2 bootstraps a WebSocket over HTTP/2 (RFC 8441) by performing an
+// HTTP/1.1 WebSocket handshake with upstream and relaying the stream once it succeeded.
+func (s *HTTPServer) handleWebSocketH2(w http.ResponseWriter, r *http.Request) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	secKey := base64.StdEncoding.EncodeToString(key)
+
+	host := r.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	out, err := http.NewRequestWithContext(s.pool.withTrace(r.Context()), http.MethodGet, "http://"+host+r.URL.RequestURI(), nil)
+	if err != nil {
+		s.writeError(w, r, newProxyError(http.StatusBadRequest, "http_request_error", "The request URL is invalid."))
+		return
+	}
+	out.Host = r.Host
+	for k, v := range r.Header {
+		if !strings.HasPrefix(k, ":") {
+			out.Header[k] = v
+		}
+	}
+	delHopHeaders(out.Header)
+	s.Forwarded.applyRequest(out.Header, r)
+	s.RequestHeaders.apply(out.Header)
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", "websocket")
+	out.Header.Set("Sec-WebSocket-Key", secKey)
+
+	resp, err := s.transport.RoundTrip(out)
+	if err != nil {
+		s.writeUpstreamError(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		s.writeError(w, r, newProxyError(http.StatusBadGateway, "http_upgrade_failed", "The destination refused the WebSocket handshake with status "+resp.Status+"."))
+		return
+	}
+
+	sum := sha1.Sum([]byte(secKey + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		s.writeError(w, r, newProxyError(http.StatusBadGateway, "http_upgrade_failed", "The destination sent an invalid Sec-WebSocket-Accept."))
+		return
+	}
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		s.writeError(w, r, newProxyError(http.StatusBadGateway, "proxy_internal_error", "The connection to the destination is not writable."))
+		return
+	}
+
+	for _, k := range []string{"Sec-WebSocket-Protocol", "Sec-WebSocket-Extensions"} {
+		if v, ok := resp.Header[k]; ok {
+			w.Header()[k] = v
+		}
+	}
+	ip, user := rateClient(r)
+	upstream = s.Accounting.readWriteCloser(upstream, user, r.Host)
+	upstream = s.RateLimiter.readWriteCloser(upstream, ip, user)
+	defer upstream.Close()
+
+	w.WriteHeader(http.StatusOK)
+	relayStream(w, r, upstream)
+}
@@ -0,0 +1,150 @@
+package wiretunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestH2CProxy returns the address of an HTTP proxy serving HTTP/2 over cleartext
+// with prior knowledge, and a client speaking only that to it.
+func newTestH2CProxy(t *testing.T, s *HTTPServer) (string, *http.Client) {
+	t.Helper()
+
+	initTestHTTPProxy(t, s)
+	proxy := httptest.NewUnstartedServer(s)
+	proxy.Config.Protocols = new(http.Protocols)
+	proxy.Config.Protocols.SetHTTP1(true)
+	proxy.Config.Protocols.SetUnencryptedHTTP2(true)
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(transport.CloseIdleConnections)
+	return proxy.Listener.Addr().String(), &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+// newEchoServer returns the address of a TCP server echoing the data received.
+func newEchoServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestH2CConnect(t *testing.T) {
+	echo := newEchoServer(t)
+	proxy, client := newTestH2CProxy(t, &HTTPServer{})
+
+	// the tunnel is the stream of the CONNECT request
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "http", Host: proxy},
+		Host:   echo,
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	resp, err := client.Transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("got HTTP/%d, want HTTP/2", resp.ProtoMajor)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := io.WriteString(pw, msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(resp.Body, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != msg {
+			t.Errorf("got %q echoed, want %q", buf, msg)
+		}
+	}
+}
+
+func TestH2CConnectError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	proxy, client := newTestH2CProxy(t, &HTTPServer{})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "http", Host: proxy},
+		Host:   closed,
+		Header: make(http.Header),
+	}
+	resp, err := client.Transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want 502", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Proxy-Status"); got != "wiretunnel; error=connection_refused" {
+		t.Errorf("got Proxy-Status %q", got)
+	}
+}
+
+func TestH2CProxyRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	defer upstream.Close()
+	proxy, client := newTestH2CProxy(t, &HTTPServer{})
+
+	// the absolute URL of the request is carried by the :scheme and :authority of the stream
+	req, _ := http.NewRequest(http.MethodGet, "http://"+proxy+"/", nil)
+	req.Host = upstream.Listener.Addr().String()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s %d", resp.Proto, resp.StatusCode)
+	}
+	// upstream is spoken to in HTTP/1.1
+	if string(body) != "HTTP/1.1" {
+		t.Errorf("upstream got %q, want HTTP/1.1", body)
+	}
+}
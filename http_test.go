@@ -0,0 +1,253 @@
+package wiretunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// initTestHTTPProxy prepares the HTTP proxy to dial upstream directly.
+func initTestHTTPProxy(t *testing.T, s *HTTPServer) {
+	t.Helper()
+
+	var err error
+	s.errorPage, err = newErrorPage(s.ErrorFormat, s.ErrorTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.dial = (&net.Dialer{}).DialContext
+	s.transport = newTransport(s.dial, s.Transport, &s.pool)
+}
+
+// newTestHTTPProxy returns the address of an HTTP proxy dialing upstream directly.
+func newTestHTTPProxy(t *testing.T, s *HTTPServer) string {
+	t.Helper()
+
+	initTestHTTPProxy(t, s)
+	proxy := httptest.NewServer(s)
+	t.Cleanup(proxy.Close)
+	return proxy.Listener.Addr().String()
+}
+
+// newProxyClient returns a client of the HTTP proxy.
+func newProxyClient(t *testing.T, proxy string) *http.Client {
+	t.Helper()
+
+	transport := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxy})}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+// sendProxyRequest writes a raw proxy request to a new connection to the proxy and
+// returns the connection and the response.
+func sendProxyRequest(t *testing.T, proxy, request string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := io.WriteString(c, request); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, br, resp
+}
+
+// newUpgradeServer returns an upstream server switching to the protocol of the
+// switch query parameter, or else to the requested one, and echoing the data received.
+func newUpgradeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) == "" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		proto := r.URL.Query().Get("switch")
+		if proto == "" {
+			proto = r.Header.Get("Upgrade")
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+proto+"\r\nKeep-Alive: timeout=5\r\n\r\n")
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestHTTPUpgrade(t *testing.T) {
+	upstream := newUpgradeServer(t)
+	proxy := newTestHTTPProxy(t, &HTTPServer{})
+	host := upstream.Listener.Addr().String()
+
+	// data sent right after the request must reach upstream once switched
+	c, br, resp := sendProxyRequest(t, proxy, "GET http://"+host+"/chat HTTP/1.1\r\nHost: "+host+
+		"\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\nearly")
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Upgrade"); got != "websocket" {
+		t.Errorf("got Upgrade %q, want websocket", got)
+	}
+	if got := resp.Header.Get("Connection"); got != "Upgrade" {
+		t.Errorf("got Connection %q, want Upgrade", got)
+	}
+	if got := resp.Header.Get("Keep-Alive"); got != "" {
+		t.Errorf("hop-by-hop header Keep-Alive %q forwarded", got)
+	}
+
+	if _, err := io.WriteString(c, " ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("early ping"))
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "early ping" {
+		t.Errorf("got %q echoed, want %q", buf, "early ping")
+	}
+}
+
+func TestHTTPUpgradeMismatch(t *testing.T) {
+	upstream := newUpgradeServer(t)
+	proxy := newTestHTTPProxy(t, &HTTPServer{})
+	host := upstream.Listener.Addr().String()
+
+	_, _, resp := sendProxyRequest(t, proxy, "GET http://"+host+"/?switch=h2c HTTP/1.1\r\nHost: "+host+
+		"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got status %d, want 502", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Proxy-Status"); got != "wiretunnel; error=http_upgrade_failed" {
+		t.Errorf("got Proxy-Status %q", got)
+	}
+}
+
+func TestHTTPWithoutUpgrade(t *testing.T) {
+	upstream := newUpgradeServer(t)
+	proxy := newTestHTTPProxy(t, &HTTPServer{})
+	host := upstream.Listener.Addr().String()
+
+	// an Upgrade header not listed in Connection is hop-by-hop and not forwarded
+	_, _, resp := sendProxyRequest(t, proxy, "GET http://"+host+"/ HTTP/1.1\r\nHost: "+host+
+		"\r\nUpgrade: websocket\r\n\r\n")
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("got status %d, want the 426 of upstream", resp.StatusCode)
+	}
+}
+
+func TestHTTPTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Te", r.Header.Get("Te"))
+		io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "declared")
+		if r.URL.Query().Has("late") {
+			w.Header().Set(http.TrailerPrefix+"X-Late", "undeclared")
+		}
+	}))
+	defer upstream.Close()
+	client := newProxyClient(t, newTestHTTPProxy(t, &HTTPServer{}))
+
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]string
+	}{
+		{name: "declared", want: map[string]string{"X-Checksum": "declared"}},
+		{name: "undeclared", query: "?late", want: map[string]string{"X-Checksum": "declared", "X-Late": "undeclared"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, upstream.URL+"/"+tt.query, nil)
+			req.Header.Set("Te", "trailers")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if got := resp.Header.Get("X-Te"); got != "trailers" {
+				t.Errorf("upstream got Te %q, want trailers", got)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil || string(body) != "body" {
+				t.Fatalf("got body %q, %v", body, err)
+			}
+			for k, want := range tt.want {
+				if got := resp.Trailer.Get(k); got != want {
+					t.Errorf("got trailer %s %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPStreaming(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if r.URL.Query().Has("length") {
+			w.Header().Set("Content-Length", "10")
+		}
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "again")
+	}))
+	defer upstream.Close()
+	client := newProxyClient(t, newTestHTTPProxy(t, &HTTPServer{}))
+
+	// bodies of unknown length and server-sent events are flushed as they arrive
+	for _, query := range []string{"?type=text/plain", "?type=text/event-stream%3B+charset=utf-8&length"} {
+		t.Run(query, func(t *testing.T) {
+			resp, err := client.Get(upstream.URL + "/" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			first := make(chan string, 1)
+			go func() {
+				buf := make([]byte, len("first"))
+				io.ReadFull(resp.Body, buf)
+				first <- string(buf)
+			}()
+			select {
+			case got := <-first:
+				if got != "first" {
+					t.Errorf("got %q, want first", got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("first chunk not flushed to the client")
+			}
+			release <- struct{}{}
+
+			rest, err := io.ReadAll(resp.Body)
+			if err != nil || string(rest) != "again" {
+				t.Errorf("got %q, %v after the first chunk", rest, err)
+			}
+		})
+	}
+}
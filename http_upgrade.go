@@ -0,0 +1,100 @@
+package wiretunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// upgradeType returns the protocol requested by the Upgrade header if the Connection
+// header contains the "upgrade" token, or an empty string.
+func upgradeType(header http.Header) string {
+	if !headerContainsToken(header, "Connection", "Upgrade") {
+		return ""
+	}
+	return header.Get("Upgrade")
+}
+
+// headerContainsToken reports whether the comma-separated values of the header contain the token.
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, v := range header[key] {
+		for _, t := range strings.Split(v, ",") {
+			t, _, _ = strings.Cut(t, ";")
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleUpgradeResponse relays a 101 Switching Protocols response to the client,
+// then splices the hijacked client connection with the upstream connection.
+func (s *HTTPServer) handleUpgradeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	reqUpType := upgradeType(r.Header)
+	resUpType := upgradeType(resp.Header)
+	if !strings.EqualFold(reqUpType, resUpType) {
+		resp.Body.Close()
+		s.writeError(w, r, newProxyError(http.StatusBadGateway, "http_upgrade_failed", fmt.Sprintf("The destination switched to the protocol %q instead of %q.", resUpType, reqUpType)))
+		return
+	}
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		s.writeError(w, r, newProxyError(http.StatusBadGateway, "proxy_internal_error", "The connection to the destination is not writable."))
+		return
+	}
+	ip, user := rateClient(r)
+	upstream = s.Accounting.readWriteCloser(upstream, user, r.Host)
+	upstream = s.RateLimiter.readWriteCloser(upstream, ip, user)
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.writeError(w, r, errHijack)
+		return
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		s.writeError(w, r, errHijack)
+		return
+	}
+	defer conn.Close()
+
+	delHopHeaders(resp.Header)
+	s.Forwarded.applyResponse(resp.Header, resp)
+	s.ResponseHeaders.apply(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", resUpType)
+
+	_, err = fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	if err == nil {
+		err = resp.Header.Write(brw)
+	}
+	if err == nil {
+		_, err = brw.WriteString("\r\n")
+	}
+	if err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	// the client may have sent data after the request before the connection was hijacked
+	go func() {
+		if n := brw.Reader.Buffered(); n > 0 {
+			buf, _ := brw.Reader.Peek(n)
+			if _, err := upstream.Write(buf); err != nil {
+				upstream.Close()
+				return
+			}
+		}
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+}
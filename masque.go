@@ -0,0 +1,260 @@
+package wiretunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// connectUDPPath is the prefix of the default URI template of RFC 9298,
+// /.well-known/masque/udp/{target_host}/{target_port}/
+const connectUDPPath = "/.well-known/masque/udp/"
+
+const (
+	capsuleDatagram  = 0x00
+	maxCapsuleLength = 65535 + 8
+)
+
+var errCapsuleTooLarge = errors.New("capsule too large")
+
+// isConnectUDP reports whether the request is a CONNECT-UDP request, an HTTP/1.1 upgrade
+// or an HTTP/2 extended CONNECT with the connect-udp protocol.
+func isConnectUDP(r *http.Request) bool {
+	if r.ProtoMajor == 2 {
+		return r.Method == http.MethodConnect && extendedConnectProtocol(r) == "connect-udp"
+	}
+	return r.Method == http.MethodGet && strings.EqualFold(upgradeType(r.Header), "connect-udp")
+}
+
+// parseConnectUDPTarget returns the target of the CONNECT-UDP request path.
+func parseConnectUDPTarget(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, connectUDPPath)
+	if !ok {
+		return "", fmt.Errorf("unknown CONNECT-UDP path %s", path)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid CONNECT-UDP path %s", path)
+	}
+
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("invalid CONNECT-UDP port %s", parts[1])
+	}
+
+	return net.JoinHostPort(host, parts[1]), nil
+}
+
+// handleConnectUDP proxies UDP datagrams carried in DATAGRAM capsules (RFC 9297) of the
+// request stream to the target of the request, as specified in RFC 9298.
+func (s *HTTPServer) handleConnectUDP(w http.ResponseWriter, r *http.Request) {
+	target, err := parseConnectUDPTarget(r.URL.EscapedPath())
+	if err != nil {
+		s.writeError(w, r, newProxyError(http.StatusBadRequest, "http_request_error", "The CONNECT-UDP target is invalid."))
+		return
+	}
+
+	if r.Header.Get("Capsule-Protocol") != "?1" {
+		s.writeError(w, r, newProxyError(http.StatusBadRequest, "http_request_error", "The capsule protocol is required."))
+		return
+	}
+
+	rc, err := dialUDP(s.Dialer, s.lookup, s.BypassList, "", target)
+	if err != nil {
+		s.writeUpstreamError(w, r, err)
+		return
+	}
+	ip, user := rateClient(r)
+	rc = s.Accounting.conn(rc, user, target)
+	rc = s.RateLimiter.conn(rc, ip, user, true)
+	defer rc.Close()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+
+	if r.ProtoMajor == 2 {
+		w.WriteHeader(http.StatusOK)
+		rwc := http.NewResponseController(w)
+		if err := rwc.Flush(); err != nil {
+			return
+		}
+		relayCapsules(rc, bufio.NewReader(r.Body), &flushWriter{w: w, rc: rwc})
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.writeError(w, r, errHijack)
+		return
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		s.writeError(w, r, errHijack)
+		return
+	}
+	defer conn.Close()
+
+	_, err = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+	if err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	relayCapsules(rc, brw.Reader, conn)
+}
+
+// relayCapsules relays the DATAGRAM capsules read from the client to the UDP connection
+// and the datagrams received from the UDP connection to the client, until either fails.
+func relayCapsules(rc net.Conn, client *bufio.Reader, w io.Writer) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer rc.Close()
+		b := make([]byte, 65507)
+		var capsule []byte
+		for {
+			n, err := rc.Read(b)
+			if err != nil {
+				return
+			}
+			capsule = appendDatagramCapsule(capsule[:0], b[:n])
+			_, err = w.Write(capsule)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		typ, value, err := readCapsule(client)
+		if err != nil {
+			break
+		}
+		if typ != capsuleDatagram {
+			// unknown capsule types must be ignored
+			continue
+		}
+
+		contextID, n := parseVarint(value)
+		if n <= 0 || contextID != 0 {
+			// only context ID 0 (UDP payload) is defined by RFC 9298
+			continue
+		}
+		_, err = rc.Write(value[n:])
+		if err != nil {
+			break
+		}
+	}
+
+	rc.Close()
+	<-done
+}
+
+// readCapsule reads a capsule (RFC 9297 section 3.2) from the reader.
+func readCapsule(r *bufio.Reader) (uint64, []byte, error) {
+	typ, err := readVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := readVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxCapsuleLength {
+		return 0, nil, errCapsuleTooLarge
+	}
+
+	value := make([]byte, length)
+	_, err = io.ReadFull(r, value)
+	if err != nil {
+		return 0, nil, err
+	}
+	return typ, value, nil
+}
+
+// appendDatagramCapsule appends a DATAGRAM capsule with context ID 0 and the payload.
+func appendDatagramCapsule(b, payload []byte) []byte {
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = appendVarint(b, 0)
+	return append(b, payload...)
+}
+
+// readVarint reads a variable-length integer as defined in RFC 9000 section 16.
+func readVarint(r *bufio.Reader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	length := 1 << (first >> 6)
+	v := uint64(first & 0x3f)
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// parseVarint parses a variable-length integer at the start of b and returns it with
+// the number of bytes read, or 0 if b is too short.
+func parseVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+
+	length := 1 << (b[0] >> 6)
+	if len(b) < length {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < length; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, length
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// flushWriter flushes the response after every write.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
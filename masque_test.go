@@ -0,0 +1,87 @@
+package wiretunnel
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestVarint(t *testing.T) {
+	tests := []struct {
+		v      uint64
+		length int
+	}{
+		{v: 0, length: 1},
+		{v: 63, length: 1},
+		{v: 64, length: 2},
+		{v: 16383, length: 2},
+		{v: 16384, length: 4},
+		{v: 1<<30 - 1, length: 4},
+		{v: 1 << 30, length: 8},
+		{v: 1<<62 - 1, length: 8},
+	}
+
+	for _, tt := range tests {
+		b := appendVarint(nil, tt.v)
+		if len(b) != tt.length {
+			t.Errorf("%d encoded in %d bytes, want %d", tt.v, len(b), tt.length)
+		}
+
+		v, n := parseVarint(b)
+		if v != tt.v || n != tt.length {
+			t.Errorf("parseVarint(%x) = %d, %d, want %d, %d", b, v, n, tt.v, tt.length)
+		}
+		if v, n := parseVarint(b[:len(b)-1]); n != 0 {
+			t.Errorf("parseVarint(%x) of a truncated varint = %d, %d, want 0 bytes read", b[:len(b)-1], v, n)
+		}
+
+		v, err := readVarint(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || v != tt.v {
+			t.Errorf("readVarint(%x) = %d, %v, want %d", b, v, err, tt.v)
+		}
+		_, err = readVarint(bufio.NewReader(bytes.NewReader(b[:len(b)-1])))
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("readVarint(%x) of a truncated varint got error %v, want EOF", b[:len(b)-1], err)
+		}
+	}
+}
+
+func TestReadCapsule(t *testing.T) {
+	payload := []byte("datagram")
+	capsule := appendDatagramCapsule(nil, payload)
+
+	typ, value, err := readCapsule(bufio.NewReader(bytes.NewReader(capsule)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != capsuleDatagram {
+		t.Errorf("got capsule type %d, want %d", typ, capsuleDatagram)
+	}
+	if !bytes.Equal(value, append([]byte{0}, payload...)) {
+		t.Errorf("got capsule value %x, want context ID 0 and the payload", value)
+	}
+
+	tests := []struct {
+		name    string
+		capsule []byte
+		wantErr error
+	}{
+		{name: "empty", capsule: nil, wantErr: io.EOF},
+		{name: "truncated type", capsule: []byte{0x40}, wantErr: io.EOF},
+		{name: "missing length", capsule: []byte{capsuleDatagram}, wantErr: io.EOF},
+		{name: "truncated length", capsule: []byte{capsuleDatagram, 0x80, 0x00}, wantErr: io.EOF},
+		{name: "truncated value", capsule: capsule[:len(capsule)-1], wantErr: io.ErrUnexpectedEOF},
+		{name: "too large", capsule: appendVarint([]byte{capsuleDatagram}, maxCapsuleLength+1), wantErr: errCapsuleTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readCapsule(bufio.NewReader(bytes.NewReader(tt.capsule)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package wiretunnel
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"strings"
 	"time"
@@ -17,8 +19,28 @@ func NewDialer(path string) (*wiredialer.WireDialer, error) {
 
 type dialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
 
-// dialWithResolver returns a dial function that resolves the address with the given resolver.
-func dialWithResolver(dial dialFunc, r Resolver) dialFunc {
+const (
+	// DefaultAttemptDelay is the delay between connection attempts recommended by RFC 8305.
+	DefaultAttemptDelay = 250 * time.Millisecond
+
+	// attemptTimeout is the timeout of a single connection attempt.
+	attemptTimeout = 10 * time.Second
+)
+
+// dialWithResolver returns a dial function that resolves the address with the given resolver
+// and races connection attempts to the resolved addresses as described in RFC 8305,
+// starting a new attempt every delay or as soon as the previous one failed.
+func dialWithResolver(dial dialFunc, r Resolver, delay time.Duration) dialFunc {
+	if delay <= 0 {
+		delay = DefaultAttemptDelay
+	}
+
+	type result struct {
+		conn   net.Conn
+		err    error
+		target string
+	}
+
 	return func(ctx context.Context, network, address string) (net.Conn, error) {
 		startTime := time.Now()
 
@@ -31,35 +53,83 @@ func dialWithResolver(dial dialFunc, r Resolver) dialFunc {
 		if err != nil {
 			return nil, fmt.Errorf("Dial: %w", err)
 		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("Dial: no address for %s", host)
+		}
 
-		// dynamically adjust the timeout based on the number of addresses
-		min := 2 * time.Second
-		max := 10 * time.Second
-		timeout := max / time.Duration(len(addrs))
-		if timeout < min {
-			timeout = min
+		attemptCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		results := make(chan result, len(addrs))
+		next, pending := 0, 0
+		startAttempt := func() {
+			target := net.JoinHostPort(addrs[next], port)
+			next++
+			pending++
+			go func() {
+				ctx, cancel := context.WithTimeout(attemptCtx, attemptTimeout)
+				defer cancel()
+				conn, err := dial(ctx, network, target)
+				results <- result{conn, err, target}
+			}()
 		}
 
-		var errorMessages []string
-
-		for _, addr := range addrs {
-			ctx, cancel := context.WithTimeout(ctx, timeout)
-			defer cancel()
-			target := net.JoinHostPort(addr, port)
-			conn, err := dial(ctx, network, target)
-			if err == nil {
-				return conn, nil
-			} else if err == context.Canceled {
-				return nil, fmt.Errorf("Dial: canceled when dialing %s after %.3f seconds", address, time.Since(startTime).Seconds())
-			} else if err == context.DeadlineExceeded {
-				err = fmt.Errorf("Dial: timed out when dialing %s", target)
+		startAttempt()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		var errs dialErrors
+
+		for pending > 0 {
+			select {
+			case res := <-results:
+				pending--
+				if res.err == nil {
+					cancel()
+					// close the connections of the attempts finishing after the winner
+					go func(n int) {
+						for range n {
+							if res := <-results; res.conn != nil {
+								res.conn.Close()
+							}
+						}
+					}(pending)
+					return res.conn, nil
+				}
+				if errors.Is(res.err, context.DeadlineExceeded) {
+					res.err = fmt.Errorf("Dial: %w when dialing %s", errTimedOut, res.target)
+				}
+				errs = append(errs, res.err)
+			case <-timer.C:
+			}
+
+			if next < len(addrs) && ctx.Err() == nil {
+				startAttempt()
+				timer.Reset(delay)
 			}
-			errorMessages = append(errorMessages, err.Error())
-			cancel()
 		}
 
-		return nil, fmt.Errorf("Dial: failed when dialing %s after %.3f seconds. Reasons: %s", address, time.Since(startTime).Seconds(), strings.Join(errorMessages, "; "))
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, fmt.Errorf("Dial: canceled when dialing %s after %.3f seconds", address, time.Since(startTime).Seconds())
+		}
+
+		return nil, fmt.Errorf("Dial: failed when dialing %s after %.3f seconds. Reasons: %w", address, time.Since(startTime).Seconds(), errs)
+	}
+}
+
+// dialErrors are the errors of the connection attempts to the addresses of a host.
+type dialErrors []error
+
+func (e dialErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
 	}
+	return strings.Join(messages, "; ")
+}
+
+func (e dialErrors) Unwrap() []error {
+	return e
 }
 
 // dialFilter returns a dial function that filters out loopback and unspecified addresses.
@@ -73,7 +143,7 @@ func dialFilter(dial dialFunc, bypassList []*net.IPNet) dialFunc {
 
 		ip := net.ParseIP(host)
 		if ip.IsLoopback() || ip.IsUnspecified() {
-			return nil, fmt.Errorf("Dial: invalid address %s", address)
+			return nil, fmt.Errorf("Dial: %w %s", errProhibitedAddress, address)
 		}
 
 		for _, bypass := range bypassList {
@@ -85,3 +155,44 @@ func dialFilter(dial dialFunc, bypassList []*net.IPNet) dialFunc {
 		return dial(ctx, network, address)
 	}
 }
+
+// dialUDP dials the UDP destination from the local source address, through the tunnel
+// or directly for addresses of the bypass list, resolving the host with lookup.
+func dialUDP(d *wiredialer.WireDialer, lookup func(host string) ([]string, error), bypassList []*net.IPNet, src, dst string) (net.Conn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", src)
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %w", err)
+	}
+
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %w", err)
+	}
+
+	addrs, err := lookup(host)
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %w", err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("Dial: no address for %s", host)
+	}
+
+	host = addrs[rand.IntN(len(addrs))]
+	dst = net.JoinHostPort(host, port)
+	raddr, err := net.ResolveUDPAddr("udp", dst)
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %w", err)
+	}
+
+	if raddr.IP.IsLoopback() || raddr.IP.IsUnspecified() {
+		return nil, fmt.Errorf("Dial: %w %s", errProhibitedAddress, dst)
+	}
+
+	for _, bypass := range bypassList {
+		if bypass.Contains(raddr.IP) {
+			return net.DialUDP("udp", laddr, raddr)
+		}
+	}
+
+	return d.DialUDP(laddr, raddr)
+}
@@ -0,0 +1,217 @@
+package wiretunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type staticResolver []string
+
+func (r staticResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r, nil
+}
+
+// testAttempt is the behavior of a fake connection attempt: it fails with err or
+// succeeds after delay, or blocks until its context is done if block is set.
+type testAttempt struct {
+	delay time.Duration
+	err   error
+	block bool
+}
+
+// closeConn records whether the connection was closed.
+type closeConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *closeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// testDialer is a dial function with the attempts of the targets, it records the targets
+// dialed in order and the connections returned.
+type testDialer struct {
+	attempts map[string]testAttempt
+
+	mutex  sync.Mutex
+	dialed []string
+	conns  map[string]*closeConn
+}
+
+func (d *testDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.dialed = append(d.dialed, address)
+	d.mutex.Unlock()
+
+	a := d.attempts[address]
+	if a.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(a.delay)
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	c, peer := net.Pipe()
+	peer.Close()
+	conn := &closeConn{Conn: c, closed: make(chan struct{})}
+	d.mutex.Lock()
+	d.conns[address] = conn
+	d.mutex.Unlock()
+	return conn, nil
+}
+
+func (d *testDialer) dialedTargets() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.dialed...)
+}
+
+func (d *testDialer) conn(address string) *closeConn {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.conns[address]
+}
+
+func newTestDialer(attempts map[string]testAttempt) *testDialer {
+	return &testDialer{attempts: attempts, conns: make(map[string]*closeConn)}
+}
+
+var testAddrs = staticResolver{"2001:db8::1", "192.0.2.1", "2001:db8::2"}
+
+func TestDialFirstAddress(t *testing.T) {
+	d := newTestDialer(nil)
+	dial := dialWithResolver(d.dial, testAddrs, 100*time.Millisecond)
+
+	c, err := dial(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c != d.conn("[2001:db8::1]:443") {
+		t.Error("connection not to the first address")
+	}
+	if dialed := d.dialedTargets(); len(dialed) != 1 {
+		t.Errorf("dialed %v, want only the first address", dialed)
+	}
+}
+
+func TestDialSlowFirstAddress(t *testing.T) {
+	d := newTestDialer(map[string]testAttempt{
+		"[2001:db8::1]:443": {block: true},
+	})
+	dial := dialWithResolver(d.dial, testAddrs, 20*time.Millisecond)
+
+	start := time.Now()
+	c, err := dial(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c != d.conn("192.0.2.1:443") {
+		t.Error("connection not to the second address")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connected after %s, want the attempt delay", elapsed)
+	}
+}
+
+func TestDialAllFail(t *testing.T) {
+	errs := []error{errors.New("refused 1"), errors.New("unreachable"), errors.New("refused 2")}
+	d := newTestDialer(map[string]testAttempt{
+		"[2001:db8::1]:443": {err: errs[0]},
+		"192.0.2.1:443":     {err: errs[1]},
+		"[2001:db8::2]:443": {err: errs[2]},
+	})
+	// a failed attempt starts the next one without waiting for the delay
+	dial := dialWithResolver(d.dial, testAddrs, time.Hour)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := dial(context.Background(), "tcp", "example.com:443")
+		done <- err
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("next attempts waited for the delay after a failure")
+	}
+	if err == nil {
+		t.Fatal("dial succeeded")
+	}
+	for _, e := range errs {
+		if !errors.Is(err, e) {
+			t.Errorf("error %q does not wrap %q", err, e)
+		}
+	}
+	want := []string{"[2001:db8::1]:443", "192.0.2.1:443", "[2001:db8::2]:443"}
+	if dialed := d.dialedTargets(); strings.Join(dialed, ",") != strings.Join(want, ",") {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+}
+
+func TestDialCanceled(t *testing.T) {
+	d := newTestDialer(map[string]testAttempt{
+		"[2001:db8::1]:443": {block: true},
+		"192.0.2.1:443":     {block: true},
+		"[2001:db8::2]:443": {block: true},
+	})
+	dial := dialWithResolver(d.dial, testAddrs, 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(150*time.Millisecond, cancel)
+
+	_, err := dial(ctx, "tcp", "example.com:443")
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("got error %v, want canceled", err)
+	}
+	if dialed := d.dialedTargets(); len(dialed) == len(testAddrs) {
+		t.Errorf("dialed %v, want no attempt after the cancellation", dialed)
+	}
+}
+
+func TestDialClosesLosers(t *testing.T) {
+	d := newTestDialer(map[string]testAttempt{
+		"[2001:db8::1]:443": {delay: 100 * time.Millisecond},
+	})
+	dial := dialWithResolver(d.dial, testAddrs, 20*time.Millisecond)
+
+	c, err := dial(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c != d.conn("192.0.2.1:443") {
+		t.Fatal("connection not to the second address")
+	}
+
+	deadline := time.After(5 * time.Second)
+	for d.conn("[2001:db8::1]:443") == nil {
+		select {
+		case <-deadline:
+			t.Fatal("first attempt did not finish")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	select {
+	case <-d.conn("[2001:db8::1]:443").closed:
+	case <-deadline:
+		t.Error("connection of the late attempt not closed")
+	}
+	select {
+	case <-d.conn("192.0.2.1:443").closed:
+		t.Error("connection of the winner closed")
+	default:
+	}
+}
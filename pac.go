@@ -0,0 +1,202 @@
+package wiretunnel
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	pacPath  = "/proxy.pac"
+	wpadPath = "/wpad.dat"
+
+	pacContentType = "application/x-ns-proxy-autoconfig"
+)
+
+// isPACRequest reports whether the request asks the server itself for the PAC file
+// rather than being a proxy request. HTTP/1 proxy requests always have an absolute URL,
+// HTTP/2 ones carry the authority of the origin like direct requests.
+func (s *HTTPServer) isPACRequest(r *http.Request) bool {
+	if !s.PAC || r.URL.Host != "" {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.URL.Path != pacPath && !(s.WPAD && r.URL.Path == wpadPath) {
+		return false
+	}
+	return r.ProtoMajor < 2 || isServerAuthority(r)
+}
+
+// isServerAuthority reports whether the authority of the request is the address the
+// connection was accepted on, a host name is only checked against its port.
+func isServerAuthority(r *http.Request) bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, localPort, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	if port != localPort {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(net.ParseIP(localHost))
+	}
+	return true
+}
+
+// routingRules is implemented by the resolvers whose static hosts and split DNS domains
+// decide which names go DIRECT in the PAC file.
+type routingRules interface {
+	// routingRules returns the static hosts and whether the DNS server of each split
+	// DNS domain is local.
+	routingRules() (hosts map[string][]string, domains map[string]bool)
+}
+
+func (r *resolver) routingRules() (map[string][]string, map[string]bool) {
+	domains := make(map[string]bool, len(r.domains))
+	for domain, u := range r.domains {
+		domains[domain] = u.local
+	}
+	return r.hosts.entries(), domains
+}
+
+// servePAC serves a proxy auto-config file which sends the bypass list, local hosts and
+// static hosts of the bypass list DIRECT, and everything else including the names of
+// split DNS domains resolved through the tunnel to the proxies, addressed by the host the
+// client used to reach this server.
+func (s *HTTPServer) servePAC(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	var proxies []string
+	if s.PACSOCKS5Address != "" {
+		proxies = append(proxies, "SOCKS5 "+pacProxyAddress(s.PACSOCKS5Address, host))
+	}
+	proxy := "PROXY "
+	if r.TLS != nil {
+		proxy = "HTTPS "
+	}
+	proxies = append(proxies, proxy+pacProxyAddress(s.Address, host))
+
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	var hosts map[string][]string
+	var domains map[string]bool
+	if rules, ok := s.Resolver.(routingRules); ok {
+		hosts, domains = rules.routingRules()
+	}
+	w.Write([]byte(generatePAC(s.BypassList, hosts, domains, strings.Join(proxies, "; "))))
+}
+
+// pacProxyAddress returns the listen address with the host replaced by the given one
+// when it listens on all interfaces.
+func pacProxyAddress(address, host string) string {
+	h, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if h == "" || net.ParseIP(h).IsUnspecified() {
+		h = host
+	}
+	return net.JoinHostPort(h, port)
+}
+
+// generatePAC returns the FindProxyForURL function, IPv6 networks are only matched by
+// browsers implementing isInNetEx. Static hosts are matched before split DNS domains,
+// both from the most specific to the least specific like the resolver does.
+func generatePAC(bypassList []*net.IPNet, hosts map[string][]string, domains map[string]bool, proxy string) string {
+	var b strings.Builder
+
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host) || host == \"localhost\" || shExpMatch(host, \"127.*\") || host == \"::1\" || host == \"[::1]\") {\n")
+	b.WriteString("\t\treturn \"DIRECT\";\n")
+	b.WriteString("\t}\n")
+
+	names := slices.Collect(maps.Keys(hosts))
+	slices.SortFunc(names, compareSpecificity)
+	for _, name := range names {
+		route := proxy
+		if len(hosts[name]) > 0 && !slices.ContainsFunc(hosts[name], func(addr string) bool {
+			return !containsIP(bypassList, net.ParseIP(addr))
+		}) {
+			route = "DIRECT"
+		}
+		if suffix, ok := strings.CutPrefix(name, "*."); ok {
+			fmt.Fprintf(&b, "\tif (dnsDomainIs(host, %q)) return %q;\n", "."+suffix, route)
+		} else {
+			fmt.Fprintf(&b, "\tif (host == %q) return %q;\n", name, route)
+		}
+	}
+
+	// names of local DNS servers are resolved by the client like any other name
+	bypassed := "bypassed(host) ? \"DIRECT\" : " + strconv.Quote(proxy)
+	if len(bypassList) == 0 {
+		bypassed = strconv.Quote(proxy)
+	}
+	names = slices.Collect(maps.Keys(domains))
+	slices.SortFunc(names, compareSpecificity)
+	for _, domain := range names {
+		route := strconv.Quote(proxy)
+		if domains[domain] {
+			route = bypassed
+		}
+		fmt.Fprintf(&b, "\tif (host == %q || dnsDomainIs(host, %q)) return %s;\n", domain, "."+domain, route)
+	}
+
+	fmt.Fprintf(&b, "\treturn %s;\n", bypassed)
+	b.WriteString("}\n")
+
+	if len(bypassList) > 0 {
+		b.WriteString("\nfunction bypassed(host) {\n")
+		b.WriteString("\tvar ip = dnsResolve(host);\n")
+		b.WriteString("\tif (!ip) return false;\n")
+		for _, n := range bypassList {
+			if n.IP.To4() != nil {
+				fmt.Fprintf(&b, "\tif (isInNet(ip, %q, %q)) return true;\n", n.IP.String(), net.IP(n.Mask).String())
+			} else {
+				fmt.Fprintf(&b, "\tif (typeof isInNetEx == \"function\" && isInNetEx(ip, %q)) return true;\n", n.String())
+			}
+		}
+		b.WriteString("\treturn false;\n")
+		b.WriteString("}\n")
+	}
+
+	return b.String()
+}
+
+// compareSpecificity orders names with more labels first, exact names before wildcards
+// of the same length which would match them, then alphabetically.
+func compareSpecificity(a, b string) int {
+	if c := strings.Count(b, ".") - strings.Count(a, "."); c != 0 {
+		return c
+	}
+	if aWild, bWild := strings.HasPrefix(a, "*."), strings.HasPrefix(b, "*."); aWild != bWild {
+		if aWild {
+			return 1
+		}
+		return -1
+	}
+	return strings.Compare(a, b)
+}
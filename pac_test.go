@@ -0,0 +1,97 @@
+package wiretunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsPACRequest(t *testing.T) {
+	s := &HTTPServer{PAC: true}
+	local := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8080}
+
+	tests := []struct {
+		name   string
+		target string
+		host   string
+		proto  int
+		want   bool
+	}{
+		{name: "HTTP/1 direct", target: "/proxy.pac", host: "192.0.2.1:8080", proto: 1, want: true},
+		{name: "HTTP/1 proxied", target: "http://example.com/proxy.pac", host: "example.com", proto: 1},
+		{name: "HTTP/1 other path", target: "/wpad.dat", host: "192.0.2.1:8080", proto: 1},
+		{name: "HTTP/2 direct", target: "/proxy.pac", host: "192.0.2.1:8080", proto: 2, want: true},
+		{name: "HTTP/2 direct by name", target: "/proxy.pac", host: "proxy.lan:8080", proto: 2, want: true},
+		{name: "HTTP/2 proxied", target: "/proxy.pac", host: "example.com", proto: 2},
+		{name: "HTTP/2 proxied to the same port", target: "/proxy.pac", host: "192.0.2.2:8080", proto: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Host = tt.host
+			r.ProtoMajor = tt.proto
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+			if got := s.isPACRequest(r); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeneratePAC(t *testing.T) {
+	_, bypass, _ := net.ParseCIDR("10.0.0.0/8")
+	hosts := map[string][]string{
+		"nas.example.com":      {"10.0.0.2"},
+		"*.example.com":        {"192.0.2.1"},
+		"mixed.example.com":    {"10.0.0.3", "192.0.2.2"},
+		"*.lan.example.com":    {"10.0.0.4"},
+		"empty.example.com":    nil,
+		"deep.a.example.com":   {"10.0.0.5"},
+		"*.deep.a.example.com": {"192.0.2.3"},
+	}
+	domains := map[string]bool{
+		"corp":     false,
+		"lan.corp": true,
+	}
+
+	pac := generatePAC([]*net.IPNet{bypass}, hosts, domains, "PROXY proxy:8080")
+
+	wantLines := []string{
+		`if (dnsDomainIs(host, ".deep.a.example.com")) return "PROXY proxy:8080";`,
+		`if (host == "deep.a.example.com") return "DIRECT";`,
+		`if (dnsDomainIs(host, ".lan.example.com")) return "DIRECT";`,
+		`if (host == "empty.example.com") return "PROXY proxy:8080";`,
+		`if (host == "mixed.example.com") return "PROXY proxy:8080";`,
+		`if (host == "nas.example.com") return "DIRECT";`,
+		`if (dnsDomainIs(host, ".example.com")) return "PROXY proxy:8080";`,
+		`if (host == "lan.corp" || dnsDomainIs(host, ".lan.corp")) return bypassed(host) ? "DIRECT" : "PROXY proxy:8080";`,
+		`if (host == "corp" || dnsDomainIs(host, ".corp")) return "PROXY proxy:8080";`,
+		`return bypassed(host) ? "DIRECT" : "PROXY proxy:8080";`,
+		`function bypassed(host) {`,
+		`if (isInNet(ip, "10.0.0.0", "255.0.0.0")) return true;`,
+	}
+	// the rules must appear in this order
+	rest := pac
+	for _, line := range wantLines {
+		i := strings.Index(rest, line)
+		if i < 0 {
+			t.Fatalf("missing or misplaced %s in\n%s", line, pac)
+		}
+		rest = rest[i+len(line):]
+	}
+}
+
+func TestGeneratePACWithoutBypassList(t *testing.T) {
+	pac := generatePAC(nil, map[string][]string{"host.example.com": {"10.0.0.1"}}, map[string]bool{"lan": true}, "PROXY proxy:8080")
+
+	if strings.Contains(pac, "bypassed") || strings.Contains(pac, "dnsResolve") {
+		t.Errorf("names resolved without a bypass list in\n%s", pac)
+	}
+	if !strings.Contains(pac, `if (host == "host.example.com") return "PROXY proxy:8080";`) {
+		t.Errorf("static host not proxied in\n%s", pac)
+	}
+}
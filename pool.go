@@ -0,0 +1,153 @@
+package wiretunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxIdleConnsPerHost   = 100
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultExpectContinueTimeout = time.Second
+)
+
+// TransportConfig controls the pool of upstream connections of the HTTP proxy, zero
+// values use the defaults.
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is the number of idle connections kept per host, default 100.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the connections per host, requests wait for a connection
+	// once it is reached. Zero means no limit.
+	MaxConnsPerHost int
+	// IdleConnTimeout closes connections idle for longer, default 90s.
+	IdleConnTimeout time.Duration
+	// ResponseHeaderTimeout limits the time to wait for the response headers once the
+	// request is written. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+	// TLSHandshakeTimeout limits the TLS handshake with upstream, default 10s.
+	TLSHandshakeTimeout time.Duration
+}
+
+// TransportStats reports the usage of the pool of upstream connections.
+type TransportStats struct {
+	// Open is the number of open connections, Idle the number of those waiting for a request.
+	Open int64
+	Idle int64
+	// Dialed is the number of connections dialed, Requests the number of requests sent
+	// and Reused the number of those sent on an already used connection.
+	Dialed   uint64
+	Requests uint64
+	Reused   uint64
+}
+
+func (t TransportStats) String() string {
+	return fmt.Sprintf("open %d, idle %d, dialed %d, requests %d, reused %d",
+		t.Open, t.Idle, t.Dialed, t.Requests, t.Reused)
+}
+
+// transportPool counts the connections of the transport.
+type transportPool struct {
+	open     atomic.Int64
+	idle     atomic.Int64
+	dialed   atomic.Uint64
+	requests atomic.Uint64
+	reused   atomic.Uint64
+}
+
+func newTransport(dial dialFunc, cfg *TransportConfig, pool *transportPool) *http.Transport {
+	if cfg == nil {
+		cfg = new(TransportConfig)
+	}
+
+	t := &http.Transport{
+		DialContext:           pool.dialer(dial),
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ExpectContinueTimeout: defaultExpectContinueTimeout,
+	}
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if t.TLSHandshakeTimeout == 0 {
+		t.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	return t
+}
+
+// dialer wraps the dial function to count the connections.
+func (p *transportPool) dialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		c, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		p.dialed.Add(1)
+		p.open.Add(1)
+		return &pooledConn{Conn: c, pool: p}, nil
+	}
+}
+
+// withTrace returns a context tracking whether the connection used by the request
+// was reused and whether it is put back in the pool afterwards.
+func (p *transportPool) withTrace(ctx context.Context) context.Context {
+	var conn *pooledConn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.requests.Add(1)
+			if info.Reused {
+				p.reused.Add(1)
+			}
+			conn, _ = info.Conn.(*pooledConn)
+			if conn != nil && conn.idle.Swap(false) {
+				p.idle.Add(-1)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil && conn != nil && !conn.idle.Swap(true) {
+				p.idle.Add(1)
+			}
+		},
+	})
+}
+
+func (p *transportPool) stats() TransportStats {
+	return TransportStats{
+		Open:     p.open.Load(),
+		Idle:     p.idle.Load(),
+		Dialed:   p.dialed.Load(),
+		Requests: p.requests.Load(),
+		Reused:   p.reused.Load(),
+	}
+}
+
+// pooledConn decrements the open and idle connections when closed.
+type pooledConn struct {
+	net.Conn
+	pool *transportPool
+	idle atomic.Bool
+	once sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() {
+		c.pool.open.Add(-1)
+		if c.idle.Swap(false) {
+			c.pool.idle.Add(-1)
+		}
+	})
+	return c.Conn.Close()
+}
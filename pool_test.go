@@ -0,0 +1,45 @@
+package wiretunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTransportStats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	s := &HTTPServer{}
+	client := newProxyClient(t, newTestHTTPProxy(t, s))
+
+	for range 3 {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// the connection is put back in the pool after the response is copied
+	var stats TransportStats
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if stats = s.TransportStats(); stats.Idle == 1 {
+			break
+		}
+	}
+	want := TransportStats{Open: 1, Idle: 1, Dialed: 1, Requests: 3, Reused: 2}
+	if stats != want {
+		t.Errorf("got %s, want %s", stats, want)
+	}
+
+	s.transport.CloseIdleConnections()
+	if stats := s.TransportStats(); stats.Open != 0 || stats.Idle != 0 {
+		t.Errorf("got %s after closing the idle connections", stats)
+	}
+}
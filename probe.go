@@ -0,0 +1,161 @@
+package wiretunnel
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeInterval = time.Minute
+	probeTimeout         = 10 * time.Second
+
+	minRetryInterval = time.Second
+	maxRetryInterval = 30 * time.Second
+)
+
+// connectivity flags stored in resolver.connectivity
+const (
+	haveIP4 uint32 = 1 << iota
+	haveIP6
+)
+
+func (r *resolver) testWGConn() error {
+	log.Print("Resolver: INFO: Testing WireGuard connection")
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	r.connectivity.Store(r.probe(ctx))
+	r.logConnectivity()
+	if r.network() == "" {
+		return errNoNetwork
+	}
+	return nil
+}
+
+// waitReady retries the DNS and tunnel checks with exponential back-off until they
+// succeed, then marks the resolver ready and starts the probe loop.
+func (r *resolver) waitReady() {
+	log.Print("Resolver: INFO: waiting for the tunnel in the background")
+	retry := minRetryInterval
+	for {
+		err := r.testDNSConn()
+		if err == nil {
+			err = r.testWGConn()
+		}
+		if err == nil {
+			break
+		}
+		log.Printf("Resolver: WARNING: tunnel not ready: %v, retrying in %s", err, retry)
+
+		select {
+		case <-r.done:
+			return
+		case <-time.After(retry):
+		}
+		retry = min(2*retry, maxRetryInterval)
+	}
+
+	r.ready.Store(true)
+	log.Print("Resolver: INFO: tunnel ready")
+	r.probeLoop()
+}
+
+// Ready reports whether the connectivity of the tunnel is confirmed.
+func (r *resolver) Ready() bool {
+	return r.ready.Load()
+}
+
+// probe dials every probe target through the tunnel and returns the connectivity flags
+// of the families with at least one reachable target.
+func (r *resolver) probe(ctx context.Context) uint32 {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var flags uint32
+	for _, target := range r.probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := r.probeDial(ctx, "tcp", target)
+			if err != nil {
+				return
+			}
+			conn.Close()
+			host, _, _ := net.SplitHostPort(target)
+			mu.Lock()
+			if net.ParseIP(host).To4() != nil {
+				flags |= haveIP4
+			} else {
+				flags |= haveIP6
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return flags
+}
+
+// probeLoop checks the connectivity of the tunnel periodically and expires the cache
+// when a family becomes reachable, so new lookups query its addresses. The cache is
+// kept when connectivity is lost to serve stale answers.
+func (r *resolver) probeLoop() {
+	ticker := time.NewTicker(r.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		flags := r.probe(ctx)
+		cancel()
+
+		old := r.connectivity.Swap(flags)
+		if old == flags {
+			continue
+		}
+		r.logConnectivity()
+
+		if flags&^old != 0 {
+			r.expireCache()
+		}
+	}
+}
+
+// Connectivity reports whether IPv4 and IPv6 destinations are reachable through the tunnel.
+func (r *resolver) Connectivity() (ip4, ip6 bool) {
+	flags := r.connectivity.Load()
+	return flags&haveIP4 != 0, flags&haveIP6 != 0
+}
+
+func (r *resolver) logConnectivity() {
+	ip4, ip6 := r.Connectivity()
+	log.Printf("Resolver: INFO: connectivity: IPv4 %s, IPv6 %s, querying %q", upDown(ip4), upDown(ip6), r.network())
+}
+
+// network returns the network to query for the available and allowed address families,
+// or an empty string if there is none.
+func (r *resolver) network() string {
+	have4, have6 := r.Connectivity()
+	ip4 := have4 && r.family != IPv6Only
+	ip6 := have6 && r.family != IPv4Only
+	if ip4 && ip6 {
+		return "ip"
+	} else if ip4 {
+		return "ip4"
+	} else if ip6 {
+		return "ip6"
+	}
+	return ""
+}
+
+func upDown(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
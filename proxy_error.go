@@ -0,0 +1,205 @@
+package wiretunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// proxyStatusName identifies the proxy in Proxy-Status headers (RFC 9209).
+const proxyStatusName = "wiretunnel"
+
+// Error page formats.
+const (
+	ErrorFormatText = "text"
+	ErrorFormatHTML = "html"
+	ErrorFormatJSON = "json"
+)
+
+var (
+	errProhibitedAddress = errors.New("prohibited address")
+	errTimedOut          = errors.New("timed out")
+)
+
+// errHijack is the response when the connection of the client cannot be hijacked.
+var errHijack = newProxyError(http.StatusInternalServerError, "proxy_internal_error", "The connection cannot be taken over.")
+
+// defaultErrorTemplate renders error pages in the html format unless a template file is set.
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .Host}}<p>Host: {{.Host}}</p>{{end}}
+<hr><p><small>{{.Type}}</small></p>
+</body>
+</html>
+`))
+
+// proxyError is an error response of the proxy, kind is one of the error types of
+// RFC 9209 section 2.3 and message is safe to show to the client.
+type proxyError struct {
+	status  int
+	kind    string
+	rcode   string
+	message string
+}
+
+func newProxyError(status int, kind, message string) *proxyError {
+	return &proxyError{status: status, kind: kind, message: message}
+}
+
+// classifyError returns the response for a failed connection to upstream or request
+// forwarded to it.
+func classifyError(err error) *proxyError {
+	var dnsErr *net.DNSError
+	var neg *negativeAnswer
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, ErrNotReady):
+		return newProxyError(http.StatusServiceUnavailable, "destination_unavailable", "The tunnel is not ready yet.")
+	case errors.Is(err, errProhibitedAddress):
+		return newProxyError(http.StatusForbidden, "destination_ip_prohibited", "Connections to this address are not allowed.")
+	case errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return newProxyError(http.StatusGatewayTimeout, "dns_timeout", "The DNS server did not answer in time.")
+	case errors.As(err, &dnsErr):
+		pe := newProxyError(http.StatusBadGateway, "dns_error", "The host name could not be resolved.")
+		if errors.As(err, &neg) {
+			if neg.nxdomain {
+				pe.rcode = "NXDOMAIN"
+			} else {
+				pe.rcode = "NOERROR"
+			}
+		}
+		return pe
+	case errors.Is(err, syscall.ECONNREFUSED) || containsError(err, "connection was refused"):
+		return newProxyError(http.StatusBadGateway, "connection_refused", "The destination refused the connection.")
+	case errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) ||
+		containsError(err, "host is unreachable", "network is unreachable", "no route"):
+		return newProxyError(http.StatusBadGateway, "destination_ip_unroutable", "The destination is unreachable.")
+	case containsError(err, "timeout awaiting response headers"):
+		return newProxyError(http.StatusGatewayTimeout, "http_response_timeout", "The destination did not respond in time.")
+	case errors.Is(err, errTimedOut) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) && netErr.Timeout():
+		return newProxyError(http.StatusGatewayTimeout, "connection_timeout", "The connection to the destination timed out.")
+	case errors.Is(err, syscall.ECONNRESET) || containsError(err, "connection reset"):
+		return newProxyError(http.StatusBadGateway, "connection_terminated", "The destination closed the connection.")
+	default:
+		return newProxyError(http.StatusBadGateway, "destination_unavailable", "The destination could not be reached.")
+	}
+}
+
+// containsError reports whether the message of the error contains one of the strings,
+// the errors of the WireGuard netstack only keep the message of the underlying error.
+func containsError(err error, s ...string) bool {
+	msg := err.Error()
+	for _, v := range s {
+		if strings.Contains(msg, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyStatus returns the value of the Proxy-Status header.
+func (pe *proxyError) proxyStatus() string {
+	v := proxyStatusName + "; error=" + pe.kind
+	if pe.rcode != "" {
+		v += "; rcode=" + strconv.Quote(pe.rcode)
+	}
+	return v
+}
+
+// errorPage renders the error responses of the proxy.
+type errorPage struct {
+	format string
+	tmpl   *template.Template
+}
+
+// newErrorPage returns the error page for the format, templateFile replaces the
+// default template of the html format.
+func newErrorPage(format, templateFile string) (*errorPage, error) {
+	p := &errorPage{format: format}
+	switch format {
+	case "", ErrorFormatText:
+		p.format = ErrorFormatText
+	case ErrorFormatHTML:
+		p.tmpl = defaultErrorTemplate
+		if templateFile != "" {
+			tmpl, err := template.ParseFiles(templateFile)
+			if err != nil {
+				return nil, fmt.Errorf("error template: %w", err)
+			}
+			p.tmpl = tmpl
+		}
+	case ErrorFormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid error page format %q", format)
+	}
+	return p, nil
+}
+
+// write writes the error response for the request.
+func (p *errorPage) write(w http.ResponseWriter, r *http.Request, pe *proxyError) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Proxy-Status", pe.proxyStatus())
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	switch {
+	case p != nil && p.format == ErrorFormatJSON:
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(pe.status)
+		json.NewEncoder(w).Encode(struct {
+			Status  int    `json:"status"`
+			Error   string `json:"error"`
+			Rcode   string `json:"rcode,omitempty"`
+			Message string `json:"message"`
+			Host    string `json:"host,omitempty"`
+		}{pe.status, pe.kind, pe.rcode, pe.message, r.Host})
+	case p != nil && p.format == ErrorFormatHTML:
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(pe.status)
+		err := p.tmpl.Execute(w, struct {
+			Status     int
+			StatusText string
+			Type       string
+			Rcode      string
+			Message    string
+			Host       string
+		}{pe.status, http.StatusText(pe.status), pe.kind, pe.rcode, pe.message, r.Host})
+		if err != nil {
+			log.Printf("HTTP proxy server: ERROR: error template: %v", err)
+		}
+	default:
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(pe.status)
+		fmt.Fprintln(w, pe.message)
+	}
+}
+
+// writeError writes the error response for the request.
+func (s *HTTPServer) writeError(w http.ResponseWriter, r *http.Request, pe *proxyError) {
+	s.errorPage.write(w, r, pe)
+}
+
+// writeUpstreamError logs the error of the connection to upstream if logging is enabled
+// and writes the error response without its details.
+func (s *HTTPServer) writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	pe := classifyError(err)
+	if s.EnableLog {
+		log.Printf("HTTP proxy server: WARNING: %s %s: %s: %v", r.Method, r.Host, pe.kind, err)
+	}
+	s.writeError(w, r, pe)
+}
@@ -0,0 +1,141 @@
+package wiretunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	u := &dnsUpstream{server: "192.0.2.53:53"}
+	nxdomain := errNoHost(u, "missing.example.com")
+	nxdomain.UnwrapErr = &negativeAnswer{nxdomain: true}
+	nodata := errNoHost(u, "v4only.example.com")
+	nodata.UnwrapErr = &negativeAnswer{}
+
+	tests := []struct {
+		name        string
+		err         error
+		status      int
+		proxyStatus string
+	}{
+		{"not ready", fmt.Errorf("Dial: %w", ErrNotReady), http.StatusServiceUnavailable, "wiretunnel; error=destination_unavailable"},
+		{"prohibited", fmt.Errorf("Dial: %w 127.0.0.1:80", errProhibitedAddress), http.StatusForbidden, "wiretunnel; error=destination_ip_prohibited"},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, http.StatusGatewayTimeout, "wiretunnel; error=dns_timeout"},
+		{"nxdomain", fmt.Errorf("Dial: %w", nxdomain), http.StatusBadGateway, `wiretunnel; error=dns_error; rcode="NXDOMAIN"`},
+		{"nodata", nodata, http.StatusBadGateway, `wiretunnel; error=dns_error; rcode="NOERROR"`},
+		{"dns failure", &net.DNSError{Err: "server misbehaving", Name: "example.com"}, http.StatusBadGateway, "wiretunnel; error=dns_error"},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, http.StatusBadGateway, "wiretunnel; error=connection_refused"},
+		{"refused in the tunnel", errors.New("connect tcp 10.0.0.1:80: connection was refused"), http.StatusBadGateway, "wiretunnel; error=connection_refused"},
+		{"unreachable", errors.New("connect tcp 10.0.0.1:80: no route to host"), http.StatusBadGateway, "wiretunnel; error=destination_ip_unroutable"},
+		{"response timeout", errors.New("net/http: timeout awaiting response headers"), http.StatusGatewayTimeout, "wiretunnel; error=http_response_timeout"},
+		{"attempts timed out", fmt.Errorf("Dial: %w when dialing 10.0.0.1:80", errTimedOut), http.StatusGatewayTimeout, "wiretunnel; error=connection_timeout"},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout, "wiretunnel; error=connection_timeout"},
+		{"reset", syscall.ECONNRESET, http.StatusBadGateway, "wiretunnel; error=connection_terminated"},
+		{"other", errors.New("something else"), http.StatusBadGateway, "wiretunnel; error=destination_unavailable"},
+	}
+
+	for _, tt := range tests {
+		pe := classifyError(tt.err)
+		if pe.status != tt.status || pe.proxyStatus() != tt.proxyStatus {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, pe.status, pe.proxyStatus(), tt.status, tt.proxyStatus)
+		}
+	}
+}
+
+func TestErrorPage(t *testing.T) {
+	tmpl := filepath.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(tmpl, []byte("<p>{{.Status}} {{.Type}} {{.Rcode}} {{.Host}}</p>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pe := newProxyError(http.StatusBadGateway, "dns_error", "The host name could not be resolved.")
+	pe.rcode = "NXDOMAIN"
+
+	tests := []struct {
+		format      string
+		template    string
+		contentType string
+		body        string
+	}{
+		{format: "", contentType: "text/plain; charset=utf-8", body: "The host name could not be resolved.\n"},
+		{format: ErrorFormatHTML, contentType: "text/html; charset=utf-8", body: "<h1>502 Bad Gateway</h1>"},
+		{format: ErrorFormatHTML, template: tmpl, contentType: "text/html; charset=utf-8", body: "<p>502 dns_error NXDOMAIN missing.example.com</p>"},
+		{format: ErrorFormatJSON, contentType: "application/json", body: `{"status":502,"error":"dns_error","rcode":"NXDOMAIN","message":"The host name could not be resolved.","host":"missing.example.com"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+tt.template, func(t *testing.T) {
+			p, err := newErrorPage(tt.format, tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Length", "42")
+			p.write(w, httptest.NewRequest(http.MethodGet, "http://missing.example.com/", nil), pe)
+
+			if w.Code != http.StatusBadGateway {
+				t.Errorf("got status %d, want 502", w.Code)
+			}
+			h := w.Header()
+			if got := h.Get("Proxy-Status"); got != `wiretunnel; error=dns_error; rcode="NXDOMAIN"` {
+				t.Errorf("got Proxy-Status %q", got)
+			}
+			if got := h.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.contentType)
+			}
+			if h.Get("Content-Length") != "" || h.Get("Cache-Control") != "no-store" {
+				t.Errorf("got Content-Length %q and Cache-Control %q", h.Get("Content-Length"), h.Get("Cache-Control"))
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("got body %q, want %q", w.Body, tt.body)
+			}
+		})
+	}
+
+	if _, err := newErrorPage("xml", ""); err == nil {
+		t.Error("invalid format accepted")
+	}
+}
+
+func TestHTTPUpstreamError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	client := newProxyClient(t, newTestHTTPProxy(t, &HTTPServer{ErrorFormat: ErrorFormatJSON}))
+	resp, err := client.Get("http://" + closed + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want 502", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Proxy-Status"); got != "wiretunnel; error=connection_refused" {
+		t.Errorf("got Proxy-Status %q", got)
+	}
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	// the details of the error are not sent to the client
+	if body.Error != "connection_refused" || strings.Contains(body.Message, closed) {
+		t.Errorf("got %+v", body)
+	}
+}
@@ -0,0 +1,548 @@
+package wiretunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rateFileCheckInterval is the interval between checks of the rate limits file for
+	// changes.
+	rateFileCheckInterval = 5 * time.Second
+
+	// rateChunksPerSecond splits the transfers of a limited relay so that slow rates
+	// send small chunks often rather than large bursts, minRateChunk bounds the chunks.
+	rateChunksPerSecond = 10
+	minRateChunk        = 1024
+)
+
+// Rate is a bandwidth limit in bytes per second of the uploads and the downloads, 0 is
+// unlimited.
+type Rate struct {
+	Upload   int64
+	Download int64
+}
+
+// RateLimits are the bandwidth limits of all the clients together, of every client IP
+// and of every authenticated user, Users overrides PerUser for some users.
+type RateLimits struct {
+	Global  Rate
+	PerIP   Rate
+	PerUser Rate
+	Users   map[string]Rate
+}
+
+// RateLimiter limits the bandwidth of the relays of the proxies with token buckets,
+// a relay is limited by the global, client IP and user buckets together. The limits
+// may be changed at runtime and apply to the relays in progress. It may be shared by
+// several servers.
+type RateLimiter struct {
+	mutex   sync.Mutex
+	limits  RateLimits
+	current RateLimits
+	global  *rateBuckets
+	ips     map[string]*rateBuckets
+	users   map[string]*rateBuckets
+
+	path    string
+	entries []rateEntry
+	modTime time.Time
+	size    int64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// rateBuckets are the upload and download buckets of a client IP, a user or all the
+// clients, refs counts the relays using them.
+type rateBuckets struct {
+	up   tokenBucket
+	down tokenBucket
+	refs int
+}
+
+// rateEntry is a line of the rate limits file, name is the user of a user entry.
+type rateEntry struct {
+	scope string
+	name  string
+	rate  Rate
+}
+
+// NewRateLimiter returns a rate limiter with the limits, the entries of the rate limits
+// file override them and it is reloaded when it changes.
+func NewRateLimiter(limits RateLimits, file string) (*RateLimiter, error) {
+	l := &RateLimiter{
+		global: newRateBuckets(Rate{}),
+		ips:    make(map[string]*rateBuckets),
+		users:  make(map[string]*rateBuckets),
+		path:   file,
+		done:   make(chan struct{}),
+	}
+
+	if file != "" {
+		err := l.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l.SetLimits(limits)
+
+	if file != "" {
+		go l.reloadLoop()
+	}
+	return l, nil
+}
+
+// Close stops checking the rate limits file for changes.
+func (l *RateLimiter) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// SetLimits replaces the limits, the entries of the rate limits file still override them.
+func (l *RateLimiter) SetLimits(limits RateLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.limits = limits
+	l.update()
+}
+
+// Limits returns the limits in effect.
+func (l *RateLimiter) Limits() RateLimits {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.current
+}
+
+// update applies the entries of the file over the limits and sets the rates of the
+// buckets in use, the mutex must be held.
+func (l *RateLimiter) update() {
+	current := l.limits
+	current.Users = make(map[string]Rate, len(l.limits.Users))
+	for user, rate := range l.limits.Users {
+		current.Users[user] = rate
+	}
+	for _, e := range l.entries {
+		switch {
+		case e.scope == "global":
+			current.Global = e.rate
+		case e.scope == "ip":
+			current.PerIP = e.rate
+		case e.scope == "user" && e.name == "":
+			current.PerUser = e.rate
+		case e.scope == "user":
+			current.Users[e.name] = e.rate
+		}
+	}
+	l.current = current
+
+	l.global.setRate(current.Global)
+	for _, b := range l.ips {
+		b.setRate(current.PerIP)
+	}
+	for user, b := range l.users {
+		b.setRate(l.userRate(user))
+	}
+}
+
+func (l *RateLimiter) userRate(user string) Rate {
+	if rate, ok := l.current.Users[user]; ok {
+		return rate
+	}
+	return l.current.PerUser
+}
+
+// acquire returns the relay of the client IP and user, it must be released once done.
+func (l *RateLimiter) acquire(ip, user string) *rateRelay {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	r := &rateRelay{limiter: l, ip: ip, user: user}
+	buckets := []*rateBuckets{l.global}
+	if ip != "" {
+		b, ok := l.ips[ip]
+		if !ok {
+			b = newRateBuckets(l.current.PerIP)
+			l.ips[ip] = b
+		}
+		b.refs++
+		buckets = append(buckets, b)
+	}
+	if user != "" {
+		b, ok := l.users[user]
+		if !ok {
+			b = newRateBuckets(l.userRate(user))
+			l.users[user] = b
+		}
+		b.refs++
+		buckets = append(buckets, b)
+	}
+
+	for _, b := range buckets {
+		r.up = append(r.up, &b.up)
+		r.down = append(r.down, &b.down)
+	}
+	return r
+}
+
+func (l *RateLimiter) release(r *rateRelay) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if b, ok := l.ips[r.ip]; ok && r.ip != "" {
+		if b.refs--; b.refs == 0 {
+			delete(l.ips, r.ip)
+		}
+	}
+	if b, ok := l.users[r.user]; ok && r.user != "" {
+		if b.refs--; b.refs == 0 {
+			delete(l.users, r.user)
+		}
+	}
+}
+
+func (l *RateLimiter) reloadLoop() {
+	ticker := time.NewTicker(rateFileCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		l.reload()
+	}
+}
+
+// reload reloads the rate limits file if it has changed since the last load.
+func (l *RateLimiter) reload() {
+	l.mutex.Lock()
+	changed := true
+	info, err := os.Stat(l.path)
+	if err == nil {
+		changed = !info.ModTime().Equal(l.modTime) || info.Size() != l.size
+	}
+	l.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Rate limiter: WARNING: failed to check rate limits file: %v", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	err = l.load()
+	if err != nil {
+		log.Printf("Rate limiter: WARNING: failed to reload rate limits file: %v", err)
+		return
+	}
+	log.Printf("Rate limiter: INFO: reloaded rate limits file %s", l.path)
+}
+
+func (l *RateLimiter) load() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	entries, err := parseRateFile(f)
+	if err != nil {
+		return fmt.Errorf("rate limits file %s: %w", l.path, err)
+	}
+
+	l.mutex.Lock()
+	l.entries = entries
+	l.modTime = info.ModTime()
+	l.size = info.Size()
+	l.update()
+	l.mutex.Unlock()
+	return nil
+}
+
+// parseRateFile parses the lines of a rate limits file: global RATE, ip RATE, user RATE
+// or user NAME RATE, with RATE in the form of ParseRate.
+func parseRateFile(r io.Reader) ([]rateEntry, error) {
+	var entries []rateEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		e := rateEntry{scope: strings.ToLower(fields[0])}
+		switch {
+		case len(fields) == 2 && (e.scope == "global" || e.scope == "ip" || e.scope == "user"):
+		case len(fields) == 3 && e.scope == "user":
+			e.name = fields[1]
+		default:
+			return nil, fmt.Errorf("invalid rate limit %q", line)
+		}
+
+		rate, err := ParseRate(fields[len(fields)-1])
+		if err != nil {
+			return nil, err
+		}
+		e.rate = rate
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+func newRateBuckets(rate Rate) *rateBuckets {
+	b := new(rateBuckets)
+	b.setRate(rate)
+	return b
+}
+
+func (b *rateBuckets) setRate(rate Rate) {
+	b.up.setRate(rate.Upload)
+	b.down.setRate(rate.Download)
+}
+
+// tokenBucket is a token bucket of bytes filled at rate bytes per second, holding at
+// most one second of tokens.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.rate > 0 {
+		b.refill(time.Now())
+	} else {
+		b.tokens = float64(rate)
+		b.last = time.Now()
+	}
+	b.rate = rate
+	b.tokens = min(b.tokens, float64(rate))
+}
+
+func (b *tokenBucket) getRate() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.rate
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(b.rate), float64(b.rate))
+	b.last = now
+}
+
+// take takes n tokens and returns the time to wait for them, the bucket goes into debt
+// so that the following transfers wait too.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// rateRelay is a relay limited by the buckets of its client, in both directions.
+type rateRelay struct {
+	limiter  *RateLimiter
+	ip       string
+	user     string
+	up       []*tokenBucket
+	down     []*tokenBucket
+	released sync.Once
+}
+
+func (r *rateRelay) release() {
+	r.released.Do(func() {
+		r.limiter.release(r)
+	})
+}
+
+// read reads from src and waits for the bytes read, split limits the size of the read.
+func (r *rateRelay) read(src io.Reader, p []byte, buckets []*tokenBucket, split bool) (int, error) {
+	if split {
+		p = p[:rateChunk(buckets, len(p))]
+	}
+	n, err := src.Read(p)
+	waitTokens(buckets, n)
+	return n, err
+}
+
+// write waits for the bytes and writes them to dst, split writes them in chunks and is
+// not suitable for datagrams.
+func (r *rateRelay) write(dst io.Writer, p []byte, buckets []*tokenBucket, split bool) (int, error) {
+	if !split {
+		waitTokens(buckets, len(p))
+		return dst.Write(p)
+	}
+
+	var written int
+	for written < len(p) {
+		chunk := p[written:]
+		chunk = chunk[:rateChunk(buckets, len(chunk))]
+		waitTokens(buckets, len(chunk))
+		n, err := dst.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// rateChunk returns the size of the transfers of at most n bytes limited by the buckets.
+func rateChunk(buckets []*tokenBucket, n int) int {
+	for _, b := range buckets {
+		if rate := b.getRate(); rate > 0 {
+			n = min(n, max(int(rate/rateChunksPerSecond), minRateChunk))
+		}
+	}
+	return n
+}
+
+// waitTokens waits until all the buckets have the n tokens.
+func waitTokens(buckets []*tokenBucket, n int) {
+	var wait time.Duration
+	for _, b := range buckets {
+		wait = max(wait, b.take(n))
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// conn limits the bandwidth of the connection to upstream of the client: writes are
+// uploads and reads downloads. The connection returned must be closed.
+func (l *RateLimiter) conn(c net.Conn, ip, user string, datagram bool) net.Conn {
+	if l == nil {
+		return c
+	}
+	return &rateConn{Conn: c, relay: l.acquire(ip, user), datagram: datagram}
+}
+
+// readWriteCloser is conn for the upstream connections which are not a net.Conn.
+func (l *RateLimiter) readWriteCloser(rwc io.ReadWriteCloser, ip, user string) io.ReadWriteCloser {
+	if l == nil {
+		return rwc
+	}
+	return &rateReadWriteCloser{ReadWriteCloser: rwc, relay: l.acquire(ip, user)}
+}
+
+// body limits the bandwidth of a request body to upstream if upload is true, or else of
+// a response body to the client. The body returned must be closed.
+func (l *RateLimiter) body(rc io.ReadCloser, ip, user string, upload bool) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	relay := l.acquire(ip, user)
+	buckets := relay.down
+	if upload {
+		buckets = relay.up
+	}
+	return &rateReadCloser{ReadCloser: rc, relay: relay, buckets: buckets}
+}
+
+type rateConn struct {
+	net.Conn
+	relay    *rateRelay
+	datagram bool
+}
+
+func (c *rateConn) Read(p []byte) (int, error) {
+	return c.relay.read(c.Conn, p, c.relay.down, !c.datagram)
+}
+
+func (c *rateConn) Write(p []byte) (int, error) {
+	return c.relay.write(c.Conn, p, c.relay.up, !c.datagram)
+}
+
+func (c *rateConn) Close() error {
+	c.relay.release()
+	return c.Conn.Close()
+}
+
+func (c *rateConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+type rateReadWriteCloser struct {
+	io.ReadWriteCloser
+	relay *rateRelay
+}
+
+func (c *rateReadWriteCloser) Read(p []byte) (int, error) {
+	return c.relay.read(c.ReadWriteCloser, p, c.relay.down, true)
+}
+
+func (c *rateReadWriteCloser) Write(p []byte) (int, error) {
+	return c.relay.write(c.ReadWriteCloser, p, c.relay.up, true)
+}
+
+func (c *rateReadWriteCloser) Close() error {
+	c.relay.release()
+	return c.ReadWriteCloser.Close()
+}
+
+func (c *rateReadWriteCloser) CloseWrite() error {
+	return closeWrite(c.ReadWriteCloser)
+}
+
+type rateReadCloser struct {
+	io.ReadCloser
+	relay   *rateRelay
+	buckets []*tokenBucket
+}
+
+func (c *rateReadCloser) Read(p []byte) (int, error) {
+	return c.relay.read(c.ReadCloser, p, c.buckets, true)
+}
+
+func (c *rateReadCloser) Close() error {
+	c.relay.release()
+	return c.ReadCloser.Close()
+}
+
+// closeWrite shuts down the writing side of the connection if supported, or else closes it.
+func closeWrite(c io.Closer) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,138 @@
+package wiretunnel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	b.setRate(1000)
+
+	if wait := b.take(1000); wait != 0 {
+		t.Fatalf("waited %s for a full bucket", wait)
+	}
+	// the bucket goes into debt, 500 bytes at 1000 B/s
+	if wait := b.take(500); wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("waited %s for 500 bytes of an empty bucket, want 500ms", wait)
+	}
+
+	b.setRate(0)
+	if wait := b.take(1 << 20); wait != 0 {
+		t.Errorf("waited %s without limit", wait)
+	}
+
+	// a lower rate caps the tokens to one second
+	b.setRate(1000)
+	b.setRate(100)
+	if wait := b.take(200); wait < 900*time.Millisecond || wait > time.Second {
+		t.Errorf("waited %s for 200 bytes at 100 B/s, want 1s", wait)
+	}
+}
+
+func TestRateChunk(t *testing.T) {
+	var slow, fast, unlimited tokenBucket
+	slow.setRate(20 * 1024)
+	fast.setRate(1 << 30)
+
+	if n := rateChunk([]*tokenBucket{&unlimited}, 32*1024); n != 32*1024 {
+		t.Errorf("got chunks of %d bytes without limit", n)
+	}
+	if n := rateChunk([]*tokenBucket{&fast, &slow}, 32*1024); n != 2048 {
+		t.Errorf("got chunks of %d bytes at 20 KB/s, want 2048", n)
+	}
+	slow.setRate(1)
+	if n := rateChunk([]*tokenBucket{&slow}, 32*1024); n != minRateChunk {
+		t.Errorf("got chunks of %d bytes at 1 B/s, want %d", n, minRateChunk)
+	}
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	l, err := NewRateLimiter(RateLimits{
+		PerIP:   Rate{Upload: 100, Download: 200},
+		PerUser: Rate{Upload: 300, Download: 300},
+		Users:   map[string]Rate{"admin": {}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	r1 := l.acquire("192.0.2.1", "alice")
+	r2 := l.acquire("192.0.2.1", "admin")
+	if len(r1.up) != 3 || r1.up[1] != r2.up[1] {
+		t.Fatal("relays of the same IP do not share its buckets")
+	}
+	if got := r1.down[1].getRate(); got != 200 {
+		t.Errorf("got IP download rate %d, want 200", got)
+	}
+	if got := r1.up[2].getRate(); got != 300 {
+		t.Errorf("got user rate %d, want 300", got)
+	}
+	if got := r2.up[2].getRate(); got != 0 {
+		t.Errorf("got rate %d for a user without limit", got)
+	}
+
+	// new limits apply to the relays in progress
+	l.SetLimits(RateLimits{PerIP: Rate{Upload: 50, Download: 50}})
+	if got := r1.up[1].getRate(); got != 50 {
+		t.Errorf("got IP rate %d after SetLimits, want 50", got)
+	}
+
+	r1.release()
+	r1.release()
+	if _, ok := l.ips["192.0.2.1"]; !ok {
+		t.Fatal("buckets of the IP released while in use")
+	}
+	r2.release()
+	if len(l.ips) != 0 || len(l.users) != 0 {
+		t.Errorf("%d IP and %d user buckets left", len(l.ips), len(l.users))
+	}
+}
+
+func TestRateLimiterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates")
+	if err := os.WriteFile(path, []byte("global 1K\nuser alice 2K/4K # comment\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewRateLimiter(RateLimits{Global: Rate{Upload: 1, Download: 1}, PerIP: Rate{Upload: 5, Download: 5}}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	limits := l.Limits()
+	if limits.Global != (Rate{Upload: 1024, Download: 1024}) || limits.PerIP != (Rate{Upload: 5, Download: 5}) {
+		t.Errorf("file entries not applied over the limits: %+v", limits)
+	}
+	if got := limits.Users["alice"]; got != (Rate{Upload: 2048, Download: 4096}) {
+		t.Errorf("got rate %+v for alice, want 2K/4K", got)
+	}
+
+	r := l.acquire("", "alice")
+	defer r.release()
+
+	if err := os.WriteFile(path, []byte("user alice 8K\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l.reload()
+	limits = l.Limits()
+	if limits.Global != (Rate{Upload: 1, Download: 1}) {
+		t.Errorf("removed file entry still applied: %+v", limits.Global)
+	}
+	if got := r.down[1].getRate(); got != 8192 {
+		t.Errorf("got rate %d for alice after a reload, want 8192", got)
+	}
+
+	// an invalid file keeps the limits in effect
+	if err := os.WriteFile(path, []byte("user alice fast\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l.reload()
+	if got := l.Limits().Users["alice"]; got != (Rate{Upload: 8192, Download: 8192}) {
+		t.Errorf("got rate %+v for alice after an invalid reload, want 8K", got)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/botanica-consulting/wiredialer"
@@ -18,128 +19,313 @@ type Resolver interface {
 	LookupHost(ctx context.Context, host string) ([]string, error)
 }
 
+// RecordResolver is implemented by the resolvers which also look up SRV and TXT records,
+// use a type assertion on a Resolver to check for it.
+type RecordResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var _ RecordResolver = (*resolver)(nil)
+
 type resolver struct {
-	client  *dns.Client
-	cache   *cache.Cache
-	mutex   *sync.RWMutex
-	server  string
-	udpSize uint16
-	haveIP4 bool
-	haveIP6 bool
-	dial    dialFunc
+	client   *dns.Client
+	cache    *cache.Cache
+	mutex    *sync.RWMutex
+	upstream *dnsUpstream
+	domains  map[string]*dnsUpstream
+	udpSize  uint16
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	family   FamilyPreference
+	hosts    *hostsTable
+
+	probes        []string
+	probeDial     dialFunc
+	probeInterval time.Duration
+	connectivity  atomic.Uint32
+	ready         atomic.Bool
+
+	cacheFile  string
+	serveStale time.Duration
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// ResolverConfig is the configuration of the resolver.
+type ResolverConfig struct {
+	// Upstream is the DNS server used for names not matching any of the Domains.
+	Upstream DNSUpstream
+
+	// Domains maps domain suffixes to the DNS server used to resolve them,
+	// the most specific suffix matching a name is used.
+	Domains map[string]DNSUpstream
+
+	// Hosts is a map of static host entries, names may start with "*." to match any subdomain.
+	Hosts map[string][]string
+
+	// HostsFile is the path of a file in the /etc/hosts format, it is reloaded when changed.
+	HostsFile string
+
+	// MinTTL and MaxTTL clamp the time answers are cached, default 1 second and 1 day.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// Family selects the address families queried and the order addresses are dialed.
+	Family FamilyPreference
+
+	// ProbeTargets are the TCP addresses dialed through the tunnel to detect IPv4 and
+	// IPv6 connectivity, default DefaultProbeTargets.
+	ProbeTargets []string
+
+	// ProbeInterval is the interval between connectivity checks, default 1 minute.
+	ProbeInterval time.Duration
+
+	// NoWait makes NewResolver return without checking the DNS servers and the tunnel,
+	// lookups fail with ErrNotReady until the checks succeed in the background.
+	NoWait bool
+
+	// CacheFile is the path of the file the cache is persisted to across restarts.
+	CacheFile string
+
+	// Prefetch refreshes frequently used entries shortly before they expire.
+	Prefetch bool
+
+	// ServeStale is the maximum time after expiration an answer may be served when
+	// upstream is unreachable (RFC 8767), 0 disables serving stale answers.
+	ServeStale time.Duration
+}
+
+// DefaultProbeTargets are the addresses used to detect the connectivity of the tunnel.
+var DefaultProbeTargets = []string{
+	"1.1.1.1:53",
+	"8.8.8.8:53",
+	"[2606:4700:4700::1111]:53",
+	"[2001:4860:4860::8888]:53",
 }
 
-var (
-	errNoNetwork    = errors.New("no network available")
-	errNoARecord    = errors.New("no A record")
-	errNoAAAARecord = errors.New("no AAAA record")
+const (
+	defaultMinTTL = time.Second
+	defaultMaxTTL = 24 * time.Hour
+
+	// maxNegativeTTL is the upper bound of negative caching recommended by RFC 2308.
+	maxNegativeTTL = 3 * time.Hour
 )
 
+var errNoNetwork = errors.New("no network available")
+
+// ErrNotReady is returned by lookups while the connectivity of the tunnel is not confirmed.
+var ErrNotReady = errors.New("tunnel not ready")
+
+// negativeAnswer is returned when the name does not exist (NXDOMAIN) or has no record
+// of the requested type (NODATA).
+type negativeAnswer struct {
+	qtype    uint16
+	nxdomain bool
+
+	// ttl is the negative caching TTL from the SOA record of the authority section,
+	// the answer must not be cached without it.
+	ttl       uint32
+	cacheable bool
+}
+
+func (e *negativeAnswer) Error() string {
+	if e.nxdomain {
+		return "no such host"
+	}
+	return "no " + dns.TypeToString[e.qtype] + " record"
+}
+
 // NewResolver creates a new Resolver.
-func NewResolver(d *wiredialer.WireDialer, localDNS bool) (*resolver, error) {
+func NewResolver(d *wiredialer.WireDialer, cfg *ResolverConfig) (*resolver, error) {
+	if cfg == nil {
+		cfg = new(ResolverConfig)
+	}
+
+	hosts, err := newHostsTable(cfg.Hosts, cfg.HostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hosts file: %w", err)
+	}
+
 	r := &resolver{
 		client:  new(dns.Client),
 		cache:   cache.New(0, 10*time.Minute),
 		mutex:   new(sync.RWMutex),
+		domains: make(map[string]*dnsUpstream, len(cfg.Domains)),
 		udpSize: 1232,
+		minTTL:  cfg.MinTTL,
+		maxTTL:  cfg.MaxTTL,
+		family:  cfg.Family,
+		hosts:   hosts,
+
+		probes:        cfg.ProbeTargets,
+		probeDial:     d.DialContext,
+		probeInterval: cfg.ProbeInterval,
+
+		cacheFile:  cfg.CacheFile,
+		serveStale: max(cfg.ServeStale, 0),
+		done:       make(chan struct{}),
+	}
+	if r.minTTL <= 0 {
+		r.minTTL = defaultMinTTL
+	}
+	if r.maxTTL <= 0 {
+		r.maxTTL = defaultMaxTTL
+	}
+	if r.maxTTL < r.minTTL {
+		r.maxTTL = r.minTTL
+	}
+	if r.probeInterval <= 0 {
+		r.probeInterval = defaultProbeInterval
+	}
+	if len(r.probes) == 0 {
+		r.probes = DefaultProbeTargets
+	}
+	for _, target := range r.probes {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid probe target %s: must be an IP address and port", target)
+		}
 	}
 
-	dnsAddrs := d.GetDNS()
-	r.server = net.JoinHostPort(dnsAddrs[0].String(), "53")
-	if len(dnsAddrs) > 1 {
-		log.Print("Resolver: WARNING: only the first DNS server is used")
+	r.upstream, err = newDNSUpstream(d, cfg.Upstream)
+	if err != nil {
+		return nil, err
 	}
 
-	if localDNS {
-		r.dial = (&net.Dialer{}).DialContext
+	for domain, u := range cfg.Domains {
+		up, err := newDNSUpstream(d, u)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", domain, err)
+		}
+		r.domains[normalizeHost(domain)] = up
+	}
+
+	if cfg.NoWait {
+		go r.waitReady()
 	} else {
-		r.dial = d.DialContext
+		err = r.testDNSConn()
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.testWGConn()
+		if err != nil {
+			return nil, err
+		}
+		r.ready.Store(true)
+		go r.probeLoop()
 	}
 
-	err := r.testDNSConn()
-	if err != nil {
-		return nil, err
+	if r.cacheFile != "" {
+		err = r.loadCache()
+		if err != nil {
+			log.Printf("Resolver: WARNING: failed to load cache: %v", err)
+		}
+		go r.saveCacheLoop()
 	}
 
-	err = r.testWGConn(d.DialContext)
-	if err != nil {
-		return nil, err
+	if cfg.Prefetch {
+		go r.prefetchLoop()
 	}
 
 	return r, nil
 }
 
+// Close stops the background tasks of the resolver and saves the cache.
+func (r *resolver) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	return r.SaveCache()
+}
+
 func (r *resolver) testDNSConn() error {
 	log.Print("Resolver: INFO: Testing DNS connection")
-	conn, err := r.dial(context.Background(), "udp", r.server)
-	if err != nil {
-		return fmt.Errorf("failed to connect to DNS server %s", r.server)
+	upstreams := []*dnsUpstream{r.upstream}
+	for _, u := range r.domains {
+		upstreams = append(upstreams, u)
 	}
-	conn.Close()
-	return nil
-}
-
-func (r *resolver) testWGConn(dial dialFunc) error {
-	log.Print("Resolver: INFO: Testing WireGuard connection")
-	var wg sync.WaitGroup
-	wg.Add(2)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	go func() {
-		defer wg.Done()
-		conn, err := dial(ctx, "tcp", "1.1.1.1:53")
-		if err == nil {
-			conn.Close()
-			r.haveIP4 = true
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		conn, err := dial(ctx, "tcp", "[2606:4700:4700::1111]:53")
-		if err == nil {
-			conn.Close()
-			r.haveIP6 = true
+	for _, u := range upstreams {
+		conn, err := u.dial(context.Background(), "udp", u.server)
+		if err != nil {
+			return fmt.Errorf("failed to connect to DNS server %s", u)
 		}
-	}()
-	wg.Wait()
-	if !r.haveIP4 && !r.haveIP6 {
-		return errNoNetwork
+		conn.Close()
 	}
 	return nil
 }
 
 // LookupHost looks up the IP addresses for the given host.
+// IP literals, static hosts and names of local upstreams are resolved before the tunnel is
+// ready, they may be dialed directly through the bypass list.
 func (r *resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
-	if net.ParseIP(host) != nil {
+	if ip := net.ParseIP(host); ip != nil {
+		if !r.family.allows(ip) {
+			return nil, fmt.Errorf("address %s not allowed by %s", host, r.family)
+		}
 		return []string{host}, nil
 	}
 
-	r.mutex.RLock()
-	c, ok := r.cache.Get(host)
-	r.mutex.RUnlock()
-	if ok {
-		addrs, ok := c.([]string)
-		if ok {
-			return addrs, nil
-		} else {
-			return nil, r.errNoHost(host)
+	if addrs, ok := r.hosts.lookup(host); ok {
+		addrs = r.orderAddrs(addrs)
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no address allowed by " + r.family.String(), Name: host, IsNotFound: true}
+		}
+		return addrs, nil
+	}
+
+	u := r.selectUpstream(host)
+	if !r.ready.Load() && !u.local {
+		return nil, ErrNotReady
+	}
+
+	var stale *cacheEntry
+	if e, ok := r.getCache(host); ok {
+		if e.fresh() {
+			e.hits.Add(1)
+			if e.addrs == nil {
+				return nil, errNoHost(u, host)
+			}
+			return e.addrs, nil
+		}
+		if e.addrs != nil {
+			stale = e
+		}
+	}
+
+	addrs, err := r.resolve(ctx, u, host)
+	if err != nil {
+		var neg *negativeAnswer
+		if stale != nil && !errors.As(err, &neg) {
+			log.Printf("Resolver: WARNING: serving stale answer for %s: %v", host, err)
+			r.serveStaleEntry(host, stale)
+			return stale.addrs, nil
 		}
+		return nil, err
 	}
 
-	var network string
-	if r.haveIP4 && r.haveIP6 {
-		network = "ip"
-	} else if r.haveIP4 {
-		network = "ip4"
-	} else if r.haveIP6 {
-		network = "ip6"
+	return addrs, nil
+}
+
+// resolve queries upstream for the addresses of the host and caches the answer.
+func (r *resolver) resolve(ctx context.Context, u *dnsUpstream, host string) ([]string, error) {
+	network := r.network()
+	if u.local && !r.ready.Load() {
+		// the connectivity of the tunnel is not known yet and does not matter locally
+		network = r.family.network()
+	}
+	if network == "" {
+		return nil, &net.DNSError{Err: errNoNetwork.Error(), Name: host, IsTemporary: true}
 	}
 
-	rec, err := r.lookupIP(ctx, network, host)
+	rec, err := r.lookupIP(ctx, u, network, host)
 	if err != nil {
-		r.mutex.Lock()
-		r.cache.Set(host, nil, 5*time.Minute)
-		r.mutex.Unlock()
+		// only cache NXDOMAIN and NODATA answers, never network errors
+		var neg *negativeAnswer
+		if errors.As(err, &neg) && neg.cacheable {
+			r.setCache(host, nil, r.clampTTL(neg.ttl, min(r.maxTTL, maxNegativeTTL)))
+		}
 		return nil, err
 	}
 
@@ -148,34 +334,33 @@ func (r *resolver) LookupHost(ctx context.Context, host string) ([]string, error
 		names[i] = ip.String()
 	}
 
-	r.mutex.Lock()
-	r.cache.Set(host, names, time.Duration(rec.ttl)*time.Second)
-	r.mutex.Unlock()
+	r.setCache(host, names, r.clampTTL(rec.ttl, r.maxTTL))
 	return names, nil
 }
 
+// clampTTL converts the TTL to a duration between r.minTTL and maxTTL,
+// it never returns 0 which means no expiration in the cache.
+func (r *resolver) clampTTL(ttl uint32, maxTTL time.Duration) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	return min(max(d, r.minTTL), maxTTL)
+}
+
 type dnsRecord struct {
 	ips []net.IP
 	ttl uint32
 }
 
-func (r *resolver) lookupIP(ctx context.Context, network, host string) (*dnsRecord, error) {
-	var ip4, ip6 []net.IP
-	var ttl uint32
+func (r *resolver) lookupIP(ctx context.Context, u *dnsUpstream, network, host string) (*dnsRecord, error) {
+	var rec4, rec6 *dnsRecord
+	var err4, err6 error
 	var wg sync.WaitGroup
-	var mu sync.Mutex
 
 	switch network {
 	case "ip", "ip4":
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if rec, err := r.lookupA(ctx, host); err == nil {
-				ip4 = rec.ips
-				mu.Lock()
-				ttl = rec.ttl
-				mu.Unlock()
-			}
+			rec4, err4 = r.lookupA(ctx, u, host)
 		}()
 	}
 
@@ -184,20 +369,34 @@ func (r *resolver) lookupIP(ctx context.Context, network, host string) (*dnsReco
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if rec, err := r.lookupAAAA(ctx, host); err == nil {
-				ip6 = rec.ips
-				mu.Lock()
-				ttl = rec.ttl
-				mu.Unlock()
-			}
+			rec6, err6 = r.lookupAAAA(ctx, u, host)
 		}()
 	}
 
 	wg.Wait()
 
-	ips := combineIPs(ip6, ip4)
+	var ip4, ip6 []net.IP
+	var ttl uint32
+	var found bool
+	for _, rec := range []*dnsRecord{rec4, rec6} {
+		if rec == nil || len(rec.ips) == 0 {
+			continue
+		}
+		if !found || rec.ttl < ttl {
+			ttl = rec.ttl
+		}
+		found = true
+	}
+	if rec4 != nil {
+		ip4 = rec4.ips
+	}
+	if rec6 != nil {
+		ip6 = rec6.ips
+	}
+
+	ips := r.family.order(append(ip6, ip4...))
 	if len(ips) == 0 {
-		return nil, r.errNoHost(host)
+		return nil, noHostError(u, host, err4, err6)
 	}
 
 	return &dnsRecord{
@@ -206,67 +405,67 @@ func (r *resolver) lookupIP(ctx context.Context, network, host string) (*dnsReco
 	}, nil
 }
 
-func (r *resolver) lookupA(ctx context.Context, host string) (*dnsRecord, error) {
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
-	m.SetEdns0(r.udpSize, true)
-	rep, _, err := r.exchangeContext(ctx, m)
+func (r *resolver) lookupA(ctx context.Context, u *dnsUpstream, host string) (*dnsRecord, error) {
+	ans, err := r.lookupRecords(ctx, u, host, dns.TypeA)
 	if err != nil {
 		return nil, err
 	}
 
-	if rep.Rcode != dns.RcodeSuccess || len(rep.Answer) == 0 {
-		return nil, errNoARecord
-	}
-
 	var ips []net.IP
-	for _, ans := range rep.Answer {
-		if a, ok := ans.(*dns.A); ok {
-			ips = append(ips, a.A)
-		}
+	for _, rr := range ans.records {
+		ips = append(ips, rr.(*dns.A).A)
 	}
 
 	return &dnsRecord{
 		ips: ips,
-		ttl: rep.Answer[0].Header().Ttl,
+		ttl: ans.ttl,
 	}, nil
 }
 
-func (r *resolver) lookupAAAA(ctx context.Context, host string) (*dnsRecord, error) {
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
-	m.SetEdns0(r.udpSize, true)
-	rep, _, err := r.exchangeContext(ctx, m)
+func (r *resolver) lookupAAAA(ctx context.Context, u *dnsUpstream, host string) (*dnsRecord, error) {
+	ans, err := r.lookupRecords(ctx, u, host, dns.TypeAAAA)
 	if err != nil {
 		return nil, err
 	}
 
-	if rep.Rcode != dns.RcodeSuccess || len(rep.Answer) == 0 {
-		return nil, errNoAAAARecord
-	}
-
 	var ips []net.IP
-	for _, ans := range rep.Answer {
-		if aaaa, ok := ans.(*dns.AAAA); ok {
-			ips = append(ips, aaaa.AAAA)
-		}
+	for _, rr := range ans.records {
+		ips = append(ips, rr.(*dns.AAAA).AAAA)
 	}
 
 	return &dnsRecord{
 		ips: ips,
-		ttl: rep.Answer[0].Header().Ttl,
+		ttl: ans.ttl,
 	}, nil
 }
 
-func (r *resolver) exchangeContext(ctx context.Context, m *dns.Msg) (rep *dns.Msg, rtt time.Duration, err error) {
+func (r *resolver) exchangeContext(ctx context.Context, u *dnsUpstream, m *dns.Msg) (rep *dns.Msg, rtt time.Duration, err error) {
 	conn := new(dns.Conn)
-	conn.Conn, err = r.dial(ctx, "udp", r.server)
+	conn.Conn, err = u.dial(ctx, "udp", u.server)
 	if err != nil {
 		return nil, 0, err
 	}
+	defer conn.Close()
 	return r.client.ExchangeWithConnContext(ctx, m, conn)
 }
 
+// orderAddrs orders the addresses by the family preference.
+func (r *resolver) orderAddrs(addrs []string) []string {
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	ips = r.family.order(ips)
+	ordered := make([]string, len(ips))
+	for i, ip := range ips {
+		ordered[i] = ip.String()
+	}
+	return ordered
+}
+
 func combineIPs(ip1, ip2 []net.IP) []net.IP {
 	ips := make([]net.IP, 0, len(ip1)+len(ip2))
 	i1, i2 := 0, 0
@@ -283,11 +482,51 @@ func combineIPs(ip1, ip2 []net.IP) []net.IP {
 	return ips
 }
 
-func (r *resolver) errNoHost(host string) error {
+func errNoHost(u *dnsUpstream, host string) *net.DNSError {
 	return &net.DNSError{
 		Err:        "no such host",
 		Name:       host,
-		Server:     r.server,
+		Server:     u.server,
 		IsNotFound: true,
 	}
 }
+
+// noHostError combines the errors of the A and AAAA lookups, the result wraps a
+// negativeAnswer only when all lookups returned one.
+func noHostError(u *dnsUpstream, host string, errs ...error) error {
+	var neg *negativeAnswer
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		var n *negativeAnswer
+		if !errors.As(err, &n) {
+			return &net.DNSError{
+				Err:         err.Error(),
+				Name:        host,
+				Server:      u.server,
+				IsTimeout:   isTimeout(err),
+				IsTemporary: true,
+			}
+		}
+		if neg == nil {
+			neg = &negativeAnswer{nxdomain: n.nxdomain, ttl: n.ttl, cacheable: n.cacheable}
+			continue
+		}
+		neg.nxdomain = neg.nxdomain || n.nxdomain
+		neg.ttl = min(neg.ttl, n.ttl)
+		neg.cacheable = neg.cacheable && n.cacheable
+	}
+
+	if neg == nil {
+		return errNoHost(u, host)
+	}
+	err := errNoHost(u, host)
+	err.UnwrapErr = neg
+	return err
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,245 @@
+package wiretunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// staleAnswerTTL is the time a stale answer is served before upstream is tried again, as recommended by RFC 8767.
+	staleAnswerTTL = 30 * time.Second
+
+	cacheSaveInterval = 5 * time.Minute
+
+	prefetchInterval = 5 * time.Second
+	prefetchMinHits  = 3
+	prefetchTimeout  = 10 * time.Second
+)
+
+// cacheEntry is a cached answer of LookupHost, addrs is nil for negative answers.
+type cacheEntry struct {
+	addrs   []string
+	ttl     time.Duration
+	expires time.Time
+	hits    atomic.Uint32
+}
+
+func (e *cacheEntry) fresh() bool {
+	return time.Now().Before(e.expires)
+}
+
+// setCache caches the answer for the host, the entry is kept in the cache after
+// its expiration when serving stale answers is enabled.
+func (r *resolver) setCache(host string, addrs []string, ttl time.Duration) {
+	e := &cacheEntry{
+		addrs:   addrs,
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+	}
+
+	r.mutex.Lock()
+	r.cache.Set(host, e, ttl+r.serveStale)
+	r.mutex.Unlock()
+}
+
+func (r *resolver) getCache(host string) (*cacheEntry, bool) {
+	r.mutex.RLock()
+	c, ok := r.cache.Get(host)
+	r.mutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return c.(*cacheEntry), true
+}
+
+// serveStaleEntry extends the stale entry for staleAnswerTTL so upstream is not
+// queried again for every request while it is unreachable.
+func (r *resolver) serveStaleEntry(host string, stale *cacheEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, expiration, ok := r.cache.GetWithExpiration(host)
+	if !ok {
+		return
+	}
+	remaining := time.Until(expiration)
+	if remaining <= 0 {
+		return
+	}
+
+	e := &cacheEntry{
+		addrs:   stale.addrs,
+		ttl:     stale.ttl,
+		expires: time.Now().Add(min(staleAnswerTTL, remaining)),
+	}
+	r.cache.Set(host, e, remaining)
+}
+
+// expireCache marks the cached answers as expired so they are queried again, they are
+// still served stale for at most the ServeStale duration. Negative answers are removed.
+func (r *resolver) expireCache() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for host, item := range r.cache.Items() {
+		e := item.Object.(*cacheEntry)
+		remaining := min(time.Until(time.Unix(0, item.Expiration)), r.serveStale)
+		if e.addrs == nil || remaining <= 0 {
+			r.cache.Delete(host)
+			continue
+		}
+		r.cache.Set(host, &cacheEntry{
+			addrs:   e.addrs,
+			ttl:     e.ttl,
+			expires: now,
+		}, remaining)
+	}
+}
+
+// prefetchLoop refreshes frequently used entries shortly before they expire.
+func (r *resolver) prefetchLoop() {
+	ticker := time.NewTicker(prefetchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		r.prefetch()
+	}
+}
+
+// prefetch refreshes the frequently used entries which expire soon.
+func (r *resolver) prefetch() {
+	r.mutex.RLock()
+	items := r.cache.Items()
+	r.mutex.RUnlock()
+
+	for host, item := range items {
+		e := item.Object.(*cacheEntry)
+		if e.addrs == nil || e.hits.Load() < prefetchMinHits || !e.fresh() {
+			continue
+		}
+		// refresh in the last tenth of the TTL, or the last interval for short TTLs
+		window := max(e.ttl/10, 2*prefetchInterval)
+		if time.Until(e.expires) > window {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+		_, err := r.resolve(ctx, r.selectUpstream(host), host)
+		cancel()
+		if err != nil {
+			log.Printf("Resolver: WARNING: failed to prefetch %s: %v", host, err)
+		}
+	}
+}
+
+type persistedEntry struct {
+	Addrs   []string      `json:"addrs"`
+	TTL     time.Duration `json:"ttl"`
+	Expires time.Time     `json:"expires"`
+}
+
+// loadCache loads the entries of the cache file which have not expired yet.
+func (r *resolver) loadCache() error {
+	b, err := os.ReadFile(r.cacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries map[string]persistedEntry
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	r.mutex.Lock()
+	for host, p := range entries {
+		remaining := time.Until(p.Expires) + r.serveStale
+		if remaining <= 0 {
+			continue
+		}
+		r.cache.Set(host, &cacheEntry{
+			addrs:   p.Addrs,
+			ttl:     p.TTL,
+			expires: p.Expires,
+		}, remaining)
+		n++
+	}
+	r.mutex.Unlock()
+
+	log.Printf("Resolver: INFO: loaded %d cache entries from %s", n, r.cacheFile)
+	return nil
+}
+
+// SaveCache writes the cache to the cache file, if any.
+func (r *resolver) SaveCache() error {
+	if r.cacheFile == "" {
+		return nil
+	}
+
+	r.mutex.RLock()
+	items := r.cache.Items()
+	r.mutex.RUnlock()
+
+	entries := make(map[string]persistedEntry, len(items))
+	for host, item := range items {
+		e := item.Object.(*cacheEntry)
+		entries[host] = persistedEntry{
+			Addrs:   e.addrs,
+			TTL:     e.ttl,
+			Expires: e.expires,
+		}
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a truncated cache file
+	f, err := os.CreateTemp(filepath.Dir(r.cacheFile), filepath.Base(r.cacheFile)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), r.cacheFile)
+}
+
+func (r *resolver) saveCacheLoop() {
+	ticker := time.NewTicker(cacheSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		err := r.SaveCache()
+		if err != nil {
+			log.Printf("Resolver: WARNING: failed to save cache: %v", err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package wiretunnel
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+func TestResolverServeStale(t *testing.T) {
+	var rcode atomic.Int32
+	rcode.Store(dns.RcodeServerFailure)
+	r, queries := newTestResolver(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		rep := new(dns.Msg)
+		rep.SetRcode(m, int(rcode.Load()))
+		w.WriteMsg(rep)
+	})
+	r.serveStale = time.Hour
+	r.setCache("host.example.com", []string{"192.0.2.1"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	addrs, err := r.LookupHost(context.Background(), "host.example.com")
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatalf("got %v, %v, want the stale answer", addrs, err)
+	}
+
+	// the stale answer is served for a while without querying upstream again
+	e, ok := r.getCache("host.example.com")
+	if !ok || !e.fresh() || time.Until(e.expires) > staleAnswerTTL {
+		t.Fatal("stale answer not served for staleAnswerTTL")
+	}
+	n := queries.Load()
+	if _, err := r.LookupHost(context.Background(), "host.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if queries.Load() != n {
+		t.Error("upstream queried again while serving the stale answer")
+	}
+
+	// a negative answer replaces the stale answer
+	rcode.Store(dns.RcodeNameError)
+	r.setCache("host.example.com", []string{"192.0.2.1"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if addrs, err := r.LookupHost(context.Background(), "host.example.com"); err == nil {
+		t.Errorf("got %v for a name which no longer exists, want an error", addrs)
+	}
+
+	// stale answers are not served when disabled
+	rcode.Store(dns.RcodeServerFailure)
+	r.serveStale = 0
+	r.setCache("other.example.com", []string{"192.0.2.2"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if addrs, err := r.LookupHost(context.Background(), "other.example.com"); err == nil {
+		t.Errorf("got %v, want an error without serving stale answers", addrs)
+	}
+}
+
+func TestResolverPrefetch(t *testing.T) {
+	var mutex sync.Mutex
+	var queried []string
+	r, _ := newTestResolver(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		mutex.Lock()
+		queried = append(queried, m.Question[0].Name)
+		mutex.Unlock()
+
+		rep := new(dns.Msg)
+		rep.SetReply(m)
+		if m.Question[0].Qtype == dns.TypeA {
+			rep.Answer = []dns.RR{testRR(t, m.Question[0].Name+" 300 IN A 192.0.2.9")}
+		}
+		w.WriteMsg(rep)
+	})
+
+	// hot and expiring in the prefetch window
+	r.setCache("hot.example.com", []string{"192.0.2.1"}, 2*prefetchInterval-time.Second)
+	// expiring but rarely used
+	r.setCache("cold.example.com", []string{"192.0.2.2"}, time.Second)
+	// hot but not in the last tenth of its TTL
+	r.setCache("long.example.com", []string{"192.0.2.3"}, time.Hour)
+	// hot but negative
+	r.setCache("missing.example.com", nil, time.Second)
+	for _, host := range []string{"hot.example.com", "long.example.com", "missing.example.com"} {
+		e, _ := r.getCache(host)
+		e.hits.Store(prefetchMinHits)
+	}
+
+	r.prefetch()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !slices.Contains(queried, "hot.example.com.") {
+		t.Error("hot entry expiring soon not prefetched")
+	}
+	for _, name := range []string{"cold.example.com.", "long.example.com.", "missing.example.com."} {
+		if slices.Contains(queried, name) {
+			t.Errorf("%s prefetched", name)
+		}
+	}
+	if ttl := cachedTTL(t, r, "hot.example.com"); ttl != 300*time.Second {
+		t.Errorf("got TTL %s after the prefetch, want 5m", ttl)
+	}
+}
+
+func TestResolverCachePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	r, _ := newTestResolver(t, func(w dns.ResponseWriter, m *dns.Msg) {})
+	r.cacheFile = path
+	r.serveStale = time.Hour
+	r.setCache("host.example.com", []string{"192.0.2.1", "2001:db8::1"}, time.Hour)
+	r.setCache("missing.example.com", nil, time.Hour)
+	r.setCache("stale.example.com", []string{"192.0.2.2"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if err := r.SaveCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		serveStale time.Duration
+		want       map[string][]string
+	}{
+		{
+			name:       "serve stale",
+			serveStale: time.Hour,
+			want: map[string][]string{
+				"host.example.com":    {"192.0.2.1", "2001:db8::1"},
+				"missing.example.com": nil,
+				"stale.example.com":   {"192.0.2.2"},
+			},
+		},
+		{
+			name: "expired entries dropped",
+			want: map[string][]string{
+				"host.example.com":    {"192.0.2.1", "2001:db8::1"},
+				"missing.example.com": nil,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := &resolver{
+				cache:      cache.New(0, time.Minute),
+				mutex:      new(sync.RWMutex),
+				cacheFile:  path,
+				serveStale: tt.serveStale,
+			}
+			if err := loaded.loadCache(); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := loaded.cache.ItemCount(); n != len(tt.want) {
+				t.Errorf("loaded %d entries, want %d", n, len(tt.want))
+			}
+			for host, want := range tt.want {
+				e, ok := loaded.getCache(host)
+				if !ok {
+					t.Errorf("%s not loaded", host)
+					continue
+				}
+				if !slices.Equal(e.addrs, want) || (e.addrs == nil) != (want == nil) {
+					t.Errorf("%s: got %v, want %v", host, e.addrs, want)
+				}
+				saved, _ := r.getCache(host)
+				if e.ttl != saved.ttl || !e.expires.Equal(saved.expires) {
+					t.Errorf("%s: got TTL %s until %s, want %s until %s", host, e.ttl, e.expires, saved.ttl, saved.expires)
+				}
+			}
+		})
+	}
+}
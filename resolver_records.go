@@ -0,0 +1,244 @@
+package wiretunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is the maximum number of CNAME records followed for a single lookup.
+const maxCNAMEChain = 8
+
+var errCNAMELoop = errors.New("CNAME loop or chain too long")
+
+// dnsAnswer is the result of a lookup after following the CNAME chain.
+type dnsAnswer struct {
+	// name is the canonical name the records belong to.
+	name    string
+	records []dns.RR
+
+	// ttl is the minimum TTL of the records and of every CNAME of the chain.
+	ttl uint32
+}
+
+// lookupRecords looks up the records of the given type for the name, following the CNAME
+// chain of the answer and querying the next name of the chain when the server did not.
+func (r *resolver) lookupRecords(ctx context.Context, u *dnsUpstream, name string, qtype uint16) (*dnsAnswer, error) {
+	name = dns.Fqdn(name)
+	visited := make(map[string]bool)
+	var chainTTL uint32
+	var chained bool
+
+	for {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.SetEdns0(r.udpSize, true)
+		rep, _, err := r.exchangeContext(ctx, u, m)
+		if err != nil {
+			return nil, err
+		}
+
+		switch rep.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+		default:
+			return nil, fmt.Errorf("server replied %s", dns.RcodeToString[rep.Rcode])
+		}
+
+		cnames := make(map[string]*dns.CNAME)
+		for _, ans := range rep.Answer {
+			if cname, ok := ans.(*dns.CNAME); ok {
+				cnames[strings.ToLower(cname.Hdr.Name)] = cname
+			}
+		}
+
+		followed := false
+		for {
+			owner := strings.ToLower(name)
+			if visited[owner] {
+				return nil, errCNAMELoop
+			}
+			visited[owner] = true
+
+			var records []dns.RR
+			for _, ans := range rep.Answer {
+				h := ans.Header()
+				if h.Rrtype == qtype && strings.EqualFold(h.Name, name) {
+					records = append(records, ans)
+				}
+			}
+			if len(records) > 0 {
+				ttl := minRecordTTL(records)
+				if chained {
+					ttl = min(ttl, chainTTL)
+				}
+				return &dnsAnswer{name: name, records: records, ttl: ttl}, nil
+			}
+
+			cname, ok := cnames[owner]
+			if !ok || qtype == dns.TypeCNAME {
+				break
+			}
+			if len(visited) > maxCNAMEChain {
+				return nil, errCNAMELoop
+			}
+			if !chained || cname.Hdr.Ttl < chainTTL {
+				chainTTL = cname.Hdr.Ttl
+			}
+			chained = true
+			followed = true
+			name = cname.Target
+		}
+
+		neg := negativeAnswerFrom(rep, qtype)
+
+		// the server returned a partial chain without data nor authority, query the next name
+		if rep.Rcode == dns.RcodeSuccess && !neg.cacheable && followed {
+			delete(visited, strings.ToLower(name))
+			continue
+		}
+
+		if chained {
+			neg.ttl = min(neg.ttl, chainTTL)
+		}
+		return nil, neg
+	}
+}
+
+// negativeAnswerFrom creates a negativeAnswer from a NXDOMAIN or NODATA reply.
+func negativeAnswerFrom(rep *dns.Msg, qtype uint16) *negativeAnswer {
+	neg := &negativeAnswer{
+		qtype:    qtype,
+		nxdomain: rep.Rcode == dns.RcodeNameError,
+	}
+
+	// RFC 2308 section 5: the negative TTL is the minimum of the SOA record TTL and its MINIMUM field
+	for _, ns := range rep.Ns {
+		if soa, ok := ns.(*dns.SOA); ok {
+			neg.ttl = min(soa.Hdr.Ttl, soa.Minttl)
+			neg.cacheable = true
+			break
+		}
+	}
+
+	return neg
+}
+
+func minRecordTTL(records []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range records {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// LookupSRV looks up the SRV records of the given service, protocol and domain name.
+// If service and proto are empty, name is looked up directly. The records are sorted
+// by priority and randomized by weight as specified in RFC 2782.
+func (r *resolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+
+	u := r.selectUpstream(target)
+	if !r.ready.Load() && !u.local {
+		return "", nil, ErrNotReady
+	}
+	ans, err := r.lookupRecords(ctx, u, target, dns.TypeSRV)
+	if err != nil {
+		return "", nil, lookupError(u, target, err)
+	}
+
+	srvs := make([]*net.SRV, 0, len(ans.records))
+	for _, rr := range ans.records {
+		srv := rr.(*dns.SRV)
+		srvs = append(srvs, &net.SRV{
+			Target:   srv.Target,
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		})
+	}
+	sortSRV(srvs)
+
+	return ans.name, srvs, nil
+}
+
+// LookupTXT looks up the TXT records of the given domain name, the strings of
+// each record are concatenated.
+func (r *resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	u := r.selectUpstream(name)
+	if !r.ready.Load() && !u.local {
+		return nil, ErrNotReady
+	}
+	ans, err := r.lookupRecords(ctx, u, name, dns.TypeTXT)
+	if err != nil {
+		return nil, lookupError(u, name, err)
+	}
+
+	txts := make([]string, 0, len(ans.records))
+	for _, rr := range ans.records {
+		txts = append(txts, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+
+	return txts, nil
+}
+
+func lookupError(u *dnsUpstream, name string, err error) error {
+	var neg *negativeAnswer
+	if errors.As(err, &neg) {
+		dnsErr := errNoHost(u, name)
+		if !neg.nxdomain {
+			dnsErr.Err = neg.Error()
+		}
+		dnsErr.UnwrapErr = neg
+		return dnsErr
+	}
+	return noHostError(u, name, err)
+}
+
+func sortSRV(srvs []*net.SRV) {
+	slices.SortStableFunc(srvs, func(a, b *net.SRV) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+
+	// shuffle each priority group by weight
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		shuffleByWeight(srvs[i:j])
+		i = j
+	}
+}
+
+func shuffleByWeight(srvs []*net.SRV) {
+	sum := 0
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+	for sum > 0 && len(srvs) > 1 {
+		s := 0
+		n := rand.IntN(sum)
+		for i := range srvs {
+			s += int(srvs[i].Weight)
+			if s > n {
+				if i > 0 {
+					srvs[0], srvs[i] = srvs[i], srvs[0]
+				}
+				break
+			}
+		}
+		sum -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
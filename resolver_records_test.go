@@ -0,0 +1,138 @@
+package wiretunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// cnameChainHandler answers every query for hN.example.com. with a single CNAME to
+// the next name of the chain, and an A record for the last one.
+func cnameChainHandler(t *testing.T, length int, loop bool) func(w dns.ResponseWriter, m *dns.Msg) {
+	return func(w dns.ResponseWriter, m *dns.Msg) {
+		rep := new(dns.Msg)
+		rep.SetReply(m)
+		q := m.Question[0]
+
+		var i int
+		fmt.Sscanf(strings.TrimPrefix(q.Name, "h"), "%d.", &i)
+		switch {
+		case i < length:
+			next := i + 1
+			if loop && next == length {
+				next = 0
+			}
+			rep.Answer = append(rep.Answer, testRR(t, fmt.Sprintf("%s 60 IN CNAME h%d.example.com.", q.Name, next)))
+		case q.Qtype == dns.TypeA:
+			rep.Answer = append(rep.Answer, testRR(t, q.Name+" 60 IN A 192.0.2.1"))
+		default:
+			rep.Ns = []dns.RR{testSOA(t, 60, 60)}
+		}
+		w.WriteMsg(rep)
+	}
+}
+
+func TestLookupRecordsCNAMEChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  int
+		loop    bool
+		wantErr error
+	}{
+		{name: "short chain", length: 3},
+		{name: "longest chain", length: maxCNAMEChain},
+		{name: "chain too long", length: maxCNAMEChain + 1, wantErr: errCNAMELoop},
+		{name: "loop", length: 3, loop: true, wantErr: errCNAMELoop},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestResolver(t, cnameChainHandler(t, tt.length, tt.loop))
+
+			ans, err := r.lookupRecords(context.Background(), r.upstream, "h0.example.com", dns.TypeA)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("h%d.example.com.", tt.length); ans.name != want {
+				t.Errorf("got canonical name %s, want %s", ans.name, want)
+			}
+			if len(ans.records) != 1 {
+				t.Errorf("got %d records, want 1", len(ans.records))
+			}
+		})
+	}
+}
+
+func TestSortSRVPriority(t *testing.T) {
+	srvs := []*net.SRV{
+		{Target: "c", Priority: 20, Weight: 5},
+		{Target: "a", Priority: 10, Weight: 0},
+		{Target: "d", Priority: 30, Weight: 0},
+		{Target: "b", Priority: 10, Weight: 10},
+		{Target: "e", Priority: 20, Weight: 5},
+	}
+
+	for range 100 {
+		sortSRV(srvs)
+		for i := 1; i < len(srvs); i++ {
+			if srvs[i-1].Priority > srvs[i].Priority {
+				t.Fatalf("records not sorted by priority: %v", srvs)
+			}
+		}
+		if srvs[4].Target != "d" {
+			t.Fatalf("got %s last, want d", srvs[4].Target)
+		}
+	}
+}
+
+func TestShuffleByWeight(t *testing.T) {
+	const runs = 10000
+	first := make(map[string]int)
+	for range runs {
+		srvs := []*net.SRV{
+			{Target: "zero", Weight: 0},
+			{Target: "light", Weight: 1},
+			{Target: "heavy", Weight: 3},
+		}
+		shuffleByWeight(srvs)
+		first[srvs[0].Target]++
+
+		seen := make(map[string]bool)
+		for _, srv := range srvs {
+			seen[srv.Target] = true
+		}
+		if len(seen) != 3 {
+			t.Fatalf("records lost by the shuffle: %v", srvs)
+		}
+	}
+
+	// RFC 2782: a record is selected with a probability proportional to its weight, and
+	// records of weight 0 have a very small chance of being selected first
+	if first["zero"] != 0 {
+		t.Errorf("weight 0 record selected first %d times", first["zero"])
+	}
+	if ratio := float64(first["heavy"]) / runs; ratio < 0.7 || ratio > 0.8 {
+		t.Errorf("weight 3 of 4 selected first %.2f of the time, want 0.75", ratio)
+	}
+}
+
+func TestShuffleByWeightZero(t *testing.T) {
+	srvs := []*net.SRV{{Target: "a"}, {Target: "b"}, {Target: "c"}}
+	shuffleByWeight(srvs)
+	for i, want := range []string{"a", "b", "c"} {
+		if srvs[i].Target != want {
+			t.Fatalf("records of weight 0 reordered: %v", srvs)
+		}
+	}
+}
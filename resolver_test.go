@@ -0,0 +1,365 @@
+package wiretunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+// newTestResolver returns a resolver querying a DNS server on the loopback interface
+// which answers with the handler, and the number of queries the server received.
+func newTestResolver(t *testing.T, handler func(w dns.ResponseWriter, m *dns.Msg)) (*resolver, *atomic.Int32) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := new(atomic.Int32)
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			queries.Add(1)
+			handler(w, m)
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	hosts, err := newHostsTable(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &resolver{
+		client: &dns.Client{Timeout: 200 * time.Millisecond},
+		cache:  cache.New(0, time.Minute),
+		mutex:  new(sync.RWMutex),
+		upstream: &dnsUpstream{
+			server: pc.LocalAddr().String(),
+			local:  true,
+			dial:   (&net.Dialer{}).DialContext,
+		},
+		udpSize: 1232,
+		minTTL:  defaultMinTTL,
+		maxTTL:  defaultMaxTTL,
+		hosts:   hosts,
+		done:    make(chan struct{}),
+	}
+	r.connectivity.Store(haveIP4 | haveIP6)
+	r.ready.Store(true)
+	return r, queries
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// testSOA returns a SOA record with the TTL and MINIMUM field.
+func testSOA(t *testing.T, ttl, minimum int) dns.RR {
+	soa := testRR(t, "example.com. 0 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 0").(*dns.SOA)
+	soa.Hdr.Ttl = uint32(ttl)
+	soa.Minttl = uint32(minimum)
+	return soa
+}
+
+func cachedTTL(t *testing.T, r *resolver, host string) time.Duration {
+	t.Helper()
+	e, ok := r.getCache(host)
+	if !ok {
+		t.Fatalf("%s is not cached", host)
+	}
+	return e.ttl
+}
+
+func TestResolverNegativeCaching(t *testing.T) {
+	tests := []struct {
+		name     string
+		rcode    int
+		soaTTL   int
+		minimum  int
+		maxTTL   time.Duration
+		wantTTL  time.Duration
+		nxdomain bool
+	}{
+		{name: "NXDOMAIN", rcode: dns.RcodeNameError, soaTTL: 3600, minimum: 60, wantTTL: time.Minute, nxdomain: true},
+		{name: "NODATA", rcode: dns.RcodeSuccess, soaTTL: 3600, minimum: 30, wantTTL: 30 * time.Second},
+		{name: "SOA TTL lower than minimum", rcode: dns.RcodeNameError, soaTTL: 20, minimum: 300, wantTTL: 20 * time.Second, nxdomain: true},
+		{name: "capped by RFC 2308", rcode: dns.RcodeNameError, soaTTL: 86400, minimum: 86400, wantTTL: maxNegativeTTL, nxdomain: true},
+		{name: "capped by MaxTTL", rcode: dns.RcodeSuccess, soaTTL: 3600, minimum: 3600, maxTTL: 10 * time.Minute, wantTTL: 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, queries := newTestResolver(t, func(w dns.ResponseWriter, m *dns.Msg) {
+				rep := new(dns.Msg)
+				rep.SetRcode(m, tt.rcode)
+				rep.Ns = []dns.RR{testSOA(t, tt.soaTTL, tt.minimum)}
+				w.WriteMsg(rep)
+			})
+			if tt.maxTTL > 0 {
+				r.maxTTL = tt.maxTTL
+			}
+
+			_, err := r.LookupHost(context.Background(), "missing.example.com")
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Fatalf("got error %v, want a not found DNS error", err)
+			}
+			var neg *negativeAnswer
+			if !errors.As(err, &neg) || neg.nxdomain != tt.nxdomain {
+				t.Fatalf("got error %v, want a negative answer with nxdomain %v", err, tt.nxdomain)
+			}
+
+			if ttl := cachedTTL(t, r, "missing.example.com"); ttl != tt.wantTTL {
+				t.Errorf("cached for %s, want %s", ttl, tt.wantTTL)
+			}
+
+			n := queries.Load()
+			_, err = r.LookupHost(context.Background(), "missing.example.com")
+			if err == nil {
+				t.Fatal("cached negative answer resolved")
+			}
+			if queries.Load() != n {
+				t.Error("cached negative answer queried upstream again")
+			}
+		})
+	}
+}
+
+func TestResolverNegativeAnswerWithoutSOA(t *testing.T) {
+	r, _ := newTestResolver(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		rep := new(dns.Msg)
+		rep.SetRcode(m, dns.RcodeNameError)
+		w.WriteMsg(rep)
+	})
+
+	_, err := r.LookupHost(context.Background(), "missing.example.com")
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	if _, ok := r.getCache("missing.example.com"); ok {
+		t.Error("negative answer without SOA record was cached")
+	}
+}
+
+func TestResolverErrorsNotCached(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w dns.ResponseWriter, m *dns.Msg)
+	}{
+		{
+			name: "SERVFAIL",
+			handler: func(w dns.ResponseWriter, m *dns.Msg) {
+				rep := new(dns.Msg)
+				rep.SetRcode(m, dns.RcodeServerFailure)
+				w.WriteMsg(rep)
+			},
+		},
+		{
+			name:    "timeout",
+			handler: func(w dns.ResponseWriter, m *dns.Msg) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, queries := newTestResolver(t, tt.handler)
+
+			for i := 1; i <= 2; i++ {
+				_, err := r.LookupHost(context.Background(), "host.example.com")
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) || dnsErr.IsNotFound || !dnsErr.IsTemporary {
+					t.Fatalf("got error %v, want a temporary DNS error", err)
+				}
+				var neg *negativeAnswer
+				if errors.As(err, &neg) {
+					t.Fatalf("got negative answer %v for a network error", err)
+				}
+				if _, ok := r.getCache("host.example.com"); ok {
+					t.Fatal("network error was cached")
+				}
+				// one A and one AAAA query per lookup
+				if got := queries.Load(); got != int32(2*i) {
+					t.Fatalf("got %d queries after %d lookups, want %d", got, i, 2*i)
+				}
+			}
+		})
+	}
+}
+
+func TestResolverTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers map[uint16][]string
+		minTTL  time.Duration
+		maxTTL  time.Duration
+		wantTTL time.Duration
+	}{
+		{
+			name:    "minimum of the records",
+			answers: map[uint16][]string{dns.TypeA: {"host.example.com. 300 IN A 192.0.2.1", "host.example.com. 60 IN A 192.0.2.2", "host.example.com. 120 IN A 192.0.2.3"}},
+			wantTTL: time.Minute,
+		},
+		{
+			name: "minimum across A and AAAA",
+			answers: map[uint16][]string{
+				dns.TypeA:    {"host.example.com. 300 IN A 192.0.2.1"},
+				dns.TypeAAAA: {"host.example.com. 50 IN AAAA 2001:db8::1", "host.example.com. 400 IN AAAA 2001:db8::2"},
+			},
+			wantTTL: 50 * time.Second,
+		},
+		{
+			name:    "minimum with the CNAME chain",
+			answers: map[uint16][]string{dns.TypeA: {"host.example.com. 30 IN CNAME target.example.com.", "target.example.com. 300 IN A 192.0.2.1"}},
+			wantTTL: 30 * time.Second,
+		},
+		{
+			name:    "clamped to MinTTL",
+			answers: map[uint16][]string{dns.TypeA: {"host.example.com. 0 IN A 192.0.2.1"}},
+			minTTL:  5 * time.Second,
+			wantTTL: 5 * time.Second,
+		},
+		{
+			name:    "MinTTL below the default",
+			answers: map[uint16][]string{dns.TypeA: {"host.example.com. 0 IN A 192.0.2.1"}},
+			minTTL:  100 * time.Millisecond,
+			wantTTL: 100 * time.Millisecond,
+		},
+		{
+			name:    "clamped to MaxTTL",
+			answers: map[uint16][]string{dns.TypeA: {"host.example.com. 1000000 IN A 192.0.2.1"}},
+			maxTTL:  time.Hour,
+			wantTTL: time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestResolver(t, func(w dns.ResponseWriter, m *dns.Msg) {
+				rep := new(dns.Msg)
+				rep.SetReply(m)
+				for _, s := range tt.answers[m.Question[0].Qtype] {
+					rep.Answer = append(rep.Answer, testRR(t, s))
+				}
+				if len(rep.Answer) == 0 {
+					rep.Ns = []dns.RR{testSOA(t, 3600, 3600)}
+				}
+				w.WriteMsg(rep)
+			})
+			if tt.minTTL > 0 {
+				r.minTTL = tt.minTTL
+			}
+			if tt.maxTTL > 0 {
+				r.maxTTL = tt.maxTTL
+			}
+
+			addrs, err := r.LookupHost(context.Background(), "host.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) == 0 {
+				t.Fatal("got no address")
+			}
+			if ttl := cachedTTL(t, r, "host.example.com"); ttl != tt.wantTTL {
+				t.Errorf("cached for %s, want %s", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestResolverExpireCache(t *testing.T) {
+	r, _ := newTestResolver(t, func(w dns.ResponseWriter, m *dns.Msg) {})
+	r.serveStale = time.Hour
+	r.setCache("host.example.com", []string{"192.0.2.1"}, time.Minute)
+	r.setCache("missing.example.com", nil, time.Minute)
+
+	r.expireCache()
+
+	e, ok := r.getCache("host.example.com")
+	if !ok {
+		t.Fatal("answer removed from the cache")
+	}
+	if e.fresh() {
+		t.Error("answer not expired")
+	}
+	if _, ok := r.getCache("missing.example.com"); ok {
+		t.Error("negative answer kept in the cache")
+	}
+
+	// the expired answer is served while upstream does not answer
+	addrs, err := r.LookupHost(context.Background(), "host.example.com")
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Errorf("got %v, %v, want the stale answer", addrs, err)
+	}
+
+	r.serveStale = 0
+	r.expireCache()
+	if _, ok := r.getCache("host.example.com"); ok {
+		t.Error("answer kept in the cache without serving stale answers")
+	}
+}
+
+func TestResolverNotReady(t *testing.T) {
+	r, _ := newTestResolver(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		rep := new(dns.Msg)
+		rep.SetReply(m)
+		if m.Question[0].Qtype == dns.TypeA {
+			rep.Answer = []dns.RR{testRR(t, m.Question[0].Name+" 60 IN A 192.0.2.1")}
+		}
+		w.WriteMsg(rep)
+	})
+	hosts, err := newHostsTable(map[string][]string{"static.example.com": {"192.0.2.2"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.hosts = hosts
+	r.domains = map[string]*dnsUpstream{
+		"tunnel.example.com": {server: r.upstream.server, dial: r.upstream.dial},
+	}
+	r.ready.Store(false)
+	r.connectivity.Store(0)
+
+	tests := []struct {
+		host    string
+		want    string
+		wantErr error
+	}{
+		{host: "192.0.2.3", want: "192.0.2.3"},
+		{host: "static.example.com", want: "192.0.2.2"},
+		{host: "local.example.com", want: "192.0.2.1"},
+		{host: "host.tunnel.example.com", wantErr: ErrNotReady},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			addrs, err := r.LookupHost(context.Background(), tt.host)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, %v, want error %v", addrs, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != 1 || addrs[0] != tt.want {
+				t.Errorf("got %v, want %s", addrs, tt.want)
+			}
+		})
+	}
+}
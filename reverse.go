@@ -0,0 +1,230 @@
+package wiretunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/botanica-consulting/wiredialer"
+)
+
+// ReverseRoute maps requests for a host and path prefix to an upstream URL.
+type ReverseRoute struct {
+	// Host matches the request host, any host if empty.
+	Host string
+	// Prefix matches the request path on segment boundaries and is removed from the
+	// path before it is appended to the path of Target.
+	Prefix string
+	Target *url.URL
+	// KeepHost forwards the Host header of the client instead of the host of Target.
+	KeepHost bool
+}
+
+// ReverseProxyServer publishes HTTP services reached through the tunnel, for clients
+// which cannot use a proxy.
+type ReverseProxyServer struct {
+	Address string
+	Routes  []ReverseRoute
+
+	// TLS serves the listener over TLS, with a self-signed certificate if TLSCertFile
+	// is empty.
+	TLS         bool
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// InsecureSkipVerify disables the verification of the certificates of HTTPS upstreams.
+	InsecureSkipVerify bool
+
+	// AllowList restricts the clients to these networks if not empty, DenyList rejects
+	// the clients of these networks.
+	AllowList []*net.IPNet
+	DenyList  []*net.IPNet
+
+	// ErrorFormat and ErrorTemplate are the same as those of HTTPServer.
+	ErrorFormat   string
+	ErrorTemplate string
+
+	// EnableLog logs the errors of the requests to upstream.
+	EnableLog bool
+
+	Dialer     *wiredialer.WireDialer
+	BypassList []*net.IPNet
+	Resolver   Resolver
+
+	// AttemptDelay is the delay between concurrent connection attempts to the
+	// resolved addresses, default DefaultAttemptDelay.
+	AttemptDelay time.Duration
+
+	proxy     *httputil.ReverseProxy
+	errorPage *errorPage
+}
+
+type reverseRouteKey struct{}
+
+// errNoReverseRoute is the response to the requests matching no route.
+var errNoReverseRoute = newProxyError(http.StatusNotFound, "destination_not_found", "No service is published at this address.")
+
+// ListenAndServe listens on the s.Address and serves the routes.
+func (s *ReverseProxyServer) ListenAndServe() error {
+	err := s.init()
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:    s.Address,
+		Handler: s,
+	}
+
+	if s.TLS || s.TLSCertFile != "" {
+		tlsConfig, err := newTLSConfig(s.TLSCertFile, s.TLSKeyFile, s.Address)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	l, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+	l = &aclListener{
+		Listener:  l,
+		server:    "Reverse proxy server",
+		allowList: s.AllowList,
+		denyList:  s.DenyList,
+	}
+
+	if server.TLSConfig != nil {
+		return server.ServeTLS(l, "", "")
+	}
+	return server.Serve(l)
+}
+
+// init sorts the routes and sets up the error page and the proxy.
+func (s *ReverseProxyServer) init() error {
+	if len(s.Routes) == 0 {
+		return errors.New("no reverse proxy route")
+	}
+
+	var err error
+	s.errorPage, err = newErrorPage(s.ErrorFormat, s.ErrorTemplate)
+	if err != nil {
+		return err
+	}
+
+	sortReverseRoutes(s.Routes)
+
+	dial := dialFilter(s.Dialer.DialContext, s.BypassList)
+	if s.Resolver != nil {
+		dial = dialWithResolver(dial, s.Resolver, s.AttemptDelay)
+	}
+
+	s.proxy = &httputil.ReverseProxy{
+		Rewrite: s.rewrite,
+		Transport: &http.Transport{
+			DialContext:           dial,
+			MaxIdleConnsPerHost:   100,
+			ExpectContinueTimeout: time.Second,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: s.InsecureSkipVerify,
+			},
+		},
+		ErrorHandler: s.writeUpstreamError,
+	}
+	return nil
+}
+
+// writeUpstreamError logs the error of the request to upstream if logging is enabled
+// and writes the error response without its details.
+func (s *ReverseProxyServer) writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	pe := classifyError(err)
+	if s.EnableLog {
+		log.Printf("Reverse proxy server: WARNING: %s %s: %s: %v", r.Method, r.URL, pe.kind, err)
+	}
+	s.errorPage.write(w, r, pe)
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *ReverseProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := s.match(r)
+	if route == nil {
+		s.errorPage.write(w, r, errNoReverseRoute)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), reverseRouteKey{}, route))
+	s.proxy.ServeHTTP(w, r)
+}
+
+// match returns the first route matching the request.
+func (s *ReverseProxyServer) match(r *http.Request) *ReverseRoute {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	for i := range s.Routes {
+		route := &s.Routes[i]
+		if route.Host != "" && !strings.EqualFold(route.Host, host) {
+			continue
+		}
+		if hasPathPrefix(r.URL.Path, route.Prefix) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (s *ReverseProxyServer) rewrite(pr *httputil.ProxyRequest) {
+	route := pr.In.Context().Value(reverseRouteKey{}).(*ReverseRoute)
+
+	// strip the prefix from the escaped path too so that escaped slashes are kept
+	pr.Out.URL.Path = stripPathPrefix(pr.In.URL.Path, route.Prefix)
+	pr.Out.URL.RawPath = ""
+	if escaped := pr.In.URL.EscapedPath(); hasPathPrefix(escaped, route.Prefix) {
+		pr.Out.URL.RawPath = stripPathPrefix(escaped, route.Prefix)
+	}
+	pr.SetURL(route.Target)
+	pr.SetXForwarded()
+	if route.KeepHost {
+		pr.Out.Host = pr.In.Host
+	}
+}
+
+// sortReverseRoutes sorts the routes from the most specific to the least: routes with a
+// host first, then by the longest prefix.
+func sortReverseRoutes(routes []ReverseRoute) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+		return len(a.Prefix) > len(b.Prefix)
+	})
+}
+
+// hasPathPrefix reports whether the path is the prefix or one of its sub-paths.
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func stripPathPrefix(path, prefix string) string {
+	path = strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/"))
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
@@ -0,0 +1,135 @@
+package wiretunnel
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestReverseProxy returns a reverse proxy with the routes to prefixes of the
+// upstream server, which answers with the escaped path and host of the requests.
+func newTestReverseProxy(t *testing.T, format string, routes map[string]string) *ReverseProxyServer {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Host", r.Host)
+		io.WriteString(w, r.URL.EscapedPath())
+	}))
+	t.Cleanup(upstream.Close)
+
+	s := &ReverseProxyServer{ErrorFormat: format}
+	for route, target := range routes {
+		r, err := ParseReverseRoutes(route + "=" + upstream.URL + target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Routes = append(s.Routes, r...)
+	}
+	if err := s.init(); err != nil {
+		t.Fatal(err)
+	}
+	// upstream is on the loopback interface, which the tunnel dialer refuses
+	s.proxy.Transport = upstream.Client().Transport
+	return s
+}
+
+func TestReverseMatch(t *testing.T) {
+	s := &ReverseProxyServer{Routes: []ReverseRoute{
+		{Prefix: "/"},
+		{Prefix: "/wiki"},
+		{Host: "grafana.local", Prefix: "/"},
+		{Prefix: "/wiki/private"},
+	}}
+	sortReverseRoutes(s.Routes)
+
+	tests := []struct {
+		host string
+		path string
+		want ReverseRoute
+	}{
+		{host: "example.com", path: "/", want: ReverseRoute{Prefix: "/"}},
+		{host: "example.com", path: "/wiki", want: ReverseRoute{Prefix: "/wiki"}},
+		{host: "example.com", path: "/wiki/page", want: ReverseRoute{Prefix: "/wiki"}},
+		{host: "example.com", path: "/wikipedia", want: ReverseRoute{Prefix: "/"}},
+		{host: "example.com", path: "/wiki/private/page", want: ReverseRoute{Prefix: "/wiki/private"}},
+		{host: "Grafana.local:8080", path: "/wiki", want: ReverseRoute{Host: "grafana.local", Prefix: "/"}},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+		got := s.match(r)
+		if got == nil || got.Host != tt.want.Host || got.Prefix != tt.want.Prefix {
+			t.Errorf("%s%s: got %+v, want %+v", tt.host, tt.path, got, tt.want)
+		}
+	}
+
+	s.Routes = []ReverseRoute{{Prefix: "/wiki"}}
+	if got := s.match(httptest.NewRequest(http.MethodGet, "/other", nil)); got != nil {
+		t.Errorf("got %+v for a path matching no route", got)
+	}
+}
+
+func TestReverseRewrite(t *testing.T) {
+	s := newTestReverseProxy(t, "", map[string]string{
+		"/app":        "/base",
+		"/":           "/",
+		"keep.local/": "/",
+	})
+	for i := range s.Routes {
+		s.Routes[i].KeepHost = s.Routes[i].Host != ""
+	}
+
+	tests := []struct {
+		url      string
+		wantPath string
+		wantHost string
+	}{
+		{url: "http://example.com/app/page", wantPath: "/base/page"},
+		{url: "http://example.com/app", wantPath: "/base/"},
+		{url: "http://example.com/app/a%2Fb/c", wantPath: "/base/a%2Fb/c"},
+		{url: "http://example.com/app/a%20b", wantPath: "/base/a%20b"},
+		{url: "http://example.com/other%2Fpath", wantPath: "/other%2Fpath"},
+		{url: "http://keep.local/page", wantPath: "/page", wantHost: "keep.local"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			if got := w.Body.String(); got != tt.wantPath {
+				t.Errorf("got upstream path %q, want %q", got, tt.wantPath)
+			}
+			if host := w.Header().Get("X-Host"); tt.wantHost != "" && host != tt.wantHost {
+				t.Errorf("got upstream host %q, want %q", host, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestReverseNotFound(t *testing.T) {
+	s := newTestReverseProxy(t, ErrorFormatJSON, map[string]string{"/app": "/"})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want 404", w.Code)
+	}
+	if got := w.Header().Get("Proxy-Status"); got != "wiretunnel; error=destination_not_found" {
+		t.Errorf("got Proxy-Status %q", got)
+	}
+	var body struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("error page not in the json format: %v", err)
+	}
+	if body.Status != http.StatusNotFound || body.Error != "destination_not_found" {
+		t.Errorf("got %+v", body)
+	}
+}
@@ -2,9 +2,12 @@ package wiretunnel
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/botanica-consulting/wiredialer"
 	"github.com/txthinking/runnergroup"
@@ -16,14 +19,54 @@ type SOCKS5Server struct {
 	Username string
 	Password string
 
+	// AuthLimiter blocks the clients failing to authenticate, failures are logged
+	// regardless.
+	AuthLimiter *AuthLimiter
+
+	// AllowList restricts the clients to these networks if not empty, DenyList rejects
+	// the clients of these networks and NoAuthList lets them skip authentication.
+	AllowList  []*net.IPNet
+	DenyList   []*net.IPNet
+	NoAuthList []*net.IPNet
+
+	// RateLimiter limits the bandwidth of the relays per client IP, user and globally.
+	// UDP datagrams count against the user of their UDP association.
+	RateLimiter *RateLimiter
+
+	// Accounting counts the bytes relayed per user and destination, and rejects the
+	// requests of the users exceeding their quota.
+	Accounting *Accounting
+
+	// TLS wraps the TCP listener in TLS, with a self-signed certificate if TLSCertFile
+	// is empty. UDP associations are not encrypted.
+	TLS         bool
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ClientCAFile enables TLS client certificate authentication with the CA certificates
+	// of the file, clients are authenticated as the identity of their certificate.
+	// Certificates are required unless Username is set.
+	ClientCAFile string
+
 	EnableLog bool
 
 	Dialer     *wiredialer.WireDialer
 	BypassList []*net.IPNet
 	Resolver   Resolver
 
-	dial   dialFunc
-	lookup func(host string) ([]string, error)
+	// AttemptDelay is the delay between concurrent connection attempts to the
+	// resolved addresses, default DefaultAttemptDelay.
+	AttemptDelay time.Duration
+
+	dial      dialFunc
+	lookup    func(host string) ([]string, error)
+	tlsConfig *tls.Config
+
+	// udpAssociations are the UDP associations by client UDP address, udpPending those
+	// by client IP whose UDP port is not known until their first datagram.
+	udpMutex        sync.Mutex
+	udpAssociations map[string]*udpAssociation
+	udpPending      map[string][]*udpAssociation
 }
 
 // ListenAndServe listens on the s.Address and serves SOCKS5 requests.
@@ -31,7 +74,7 @@ func (s *SOCKS5Server) ListenAndServe() error {
 	s.dial = dialFilter(s.Dialer.DialContext, s.BypassList)
 	s.lookup = s.Dialer.LookupHost
 	if s.Resolver != nil {
-		s.dial = dialWithResolver(s.dial, s.Resolver)
+		s.dial = dialWithResolver(s.dial, s.Resolver, s.AttemptDelay)
 		s.lookup = func(host string) ([]string, error) {
 			return s.Resolver.LookupHost(context.Background(), host)
 		}
@@ -41,6 +84,20 @@ func (s *SOCKS5Server) ListenAndServe() error {
 		return errors.New("username is set but password is empty")
 	}
 
+	if s.TLS || s.TLSCertFile != "" || s.ClientCAFile != "" {
+		tlsConfig, err := newTLSConfig(s.TLSCertFile, s.TLSKeyFile, s.Address)
+		if err != nil {
+			return err
+		}
+		if s.ClientCAFile != "" {
+			err = setClientCAs(tlsConfig, s.ClientCAFile, s.Username == "" && len(s.NoAuthList) == 0)
+			if err != nil {
+				return err
+			}
+		}
+		s.tlsConfig = tlsConfig
+	}
+
 	server, err := socks5.NewClassicServer(s.Address, "", s.Username, s.Password, 0, 0)
 	if err != nil {
 		return err
@@ -50,6 +107,9 @@ func (s *SOCKS5Server) ListenAndServe() error {
 }
 
 func (s *SOCKS5Server) listenAndServe(ss *socks5.Server) error {
+	s.udpAssociations = make(map[string]*udpAssociation)
+	s.udpPending = make(map[string][]*udpAssociation)
+
 	tcpAddr, err := net.ResolveTCPAddr("tcp", ss.Addr)
 	if err != nil {
 		return err
@@ -66,9 +126,19 @@ func (s *SOCKS5Server) listenAndServe(ss *socks5.Server) error {
 				if err != nil {
 					return err
 				}
-				go func(c *net.TCPConn) {
+				if !clientAllowed(addrIP(c.RemoteAddr()), s.AllowList, s.DenyList) {
+					log.Printf("SOCKS5 proxy server: WARNING: rejected connection from %s", c.RemoteAddr())
+					c.Close()
+					continue
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					c, certUser, err := s.handshake(c)
+					if err != nil {
+						return
+					}
 					defer c.Close()
-					err := ss.Negotiate(c)
+					user, err := s.negotiate(c, certUser)
 					if err != nil {
 						return
 					}
@@ -76,7 +146,7 @@ func (s *SOCKS5Server) listenAndServe(ss *socks5.Server) error {
 					if err != nil {
 						return
 					}
-					err = s.tcpHandle(c, r)
+					err = s.tcpHandle(c, r, user)
 					if s.EnableLog && err != nil {
 						log.Printf("SOCKS5 proxy server: TCP: %s: ERROR: %v", c.RemoteAddr(), err)
 					}
@@ -107,6 +177,12 @@ func (s *SOCKS5Server) listenAndServe(ss *socks5.Server) error {
 				if err != nil {
 					return err
 				}
+				if !clientAllowed(addr.IP, s.AllowList, s.DenyList) {
+					if s.EnableLog {
+						log.Printf("SOCKS5 proxy server: UDP: %s: WARNING: rejected datagram", addr)
+					}
+					continue
+				}
 				go func(addr *net.UDPAddr, b []byte) {
 					d, err := socks5.NewDatagramFromBytes(b)
 					if err != nil {
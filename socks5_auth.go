@@ -0,0 +1,117 @@
+package wiretunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/txthinking/socks5"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+var (
+	errNoAcceptableMethod = errors.New("no acceptable authentication method")
+	errAuthBlocked        = errors.New("too many failed authentications")
+)
+
+// handshake performs the TLS handshake if the server is TLS-wrapped and returns the
+// connection to use and the identity of the verified client certificate, if any.
+func (s *SOCKS5Server) handshake(c net.Conn) (net.Conn, string, error) {
+	if s.tlsConfig == nil {
+		return c, "", nil
+	}
+
+	tc := tls.Server(c, s.tlsConfig)
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tc.Handshake()
+	if err != nil {
+		return nil, "", err
+	}
+	tc.SetDeadline(time.Time{})
+
+	cs := tc.ConnectionState()
+	user, _ := certIdentity(&cs)
+	return tc, user, nil
+}
+
+// negotiate performs the SOCKS5 method negotiation and returns the authenticated user.
+// Clients authenticated by their certificate or from NoAuthList, and all clients of a
+// server without authentication, may skip username/password authentication: their
+// credentials are accepted without being checked.
+func (s *SOCKS5Server) negotiate(c net.Conn, certUser string) (string, error) {
+	ip := remoteIP(c.RemoteAddr().String())
+	noAuth := containsIP(s.NoAuthList, addrIP(c.RemoteAddr()))
+	open := s.Username == "" && s.ClientCAFile == ""
+
+	rq, err := socks5.NewNegotiationRequestFrom(c)
+	if err != nil {
+		return "", err
+	}
+
+	// blocked clients are told that no method is acceptable
+	remaining, blocked := s.AuthLimiter.blocked(ip)
+	blocked = blocked && certUser == "" && !noAuth && !open
+
+	method := socks5.MethodUnsupportAll
+	switch {
+	case blocked:
+	case open || certUser != "" || noAuth:
+		if slices.Contains(rq.Methods, socks5.MethodNone) {
+			method = socks5.MethodNone
+		} else if slices.Contains(rq.Methods, socks5.MethodUsernamePassword) {
+			method = socks5.MethodUsernamePassword
+		}
+	case s.Username != "":
+		if slices.Contains(rq.Methods, socks5.MethodUsernamePassword) {
+			method = socks5.MethodUsernamePassword
+		}
+	}
+
+	rp := socks5.NewNegotiationReply(method)
+	if _, err := rp.WriteTo(c); err != nil {
+		return "", err
+	}
+	if blocked {
+		authBlocked("SOCKS5 proxy server", ip, remaining)
+		return "", errAuthBlocked
+	}
+	if method == socks5.MethodUnsupportAll {
+		return "", errNoAcceptableMethod
+	}
+	if method == socks5.MethodNone {
+		return certUser, nil
+	}
+
+	urq, err := socks5.NewUserPassNegotiationRequestFrom(c)
+	if err != nil {
+		return "", err
+	}
+
+	// credentials are not checked when the certificate already authenticated the client,
+	// the client network needs no authentication or the server none at all
+	skip := certUser != "" || noAuth || open
+	user := certUser
+	status := socks5.UserPassStatusSuccess
+	if !skip {
+		user = string(urq.Uname)
+		if s.Username == "" || user != s.Username || string(urq.Passwd) != s.Password {
+			status = socks5.UserPassStatusFailure
+		}
+	}
+
+	urp := socks5.NewUserPassNegotiationReply(status)
+	if _, err := urp.WriteTo(c); err != nil {
+		return "", err
+	}
+	if status != socks5.UserPassStatusSuccess {
+		authFailed(s.AuthLimiter, "SOCKS5 proxy server", ip, user)
+		return "", socks5.ErrUserPassAuth
+	}
+	if !skip {
+		s.AuthLimiter.succeed(ip)
+	}
+	return user, nil
+}
@@ -0,0 +1,77 @@
+package wiretunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/txthinking/socks5"
+)
+
+// negotiateUserPass runs the negotiation of a client offering only username/password
+// authentication with the credentials, and returns the negotiated user.
+func negotiateUserPass(t *testing.T, s *SOCKS5Server, user, password string) (string, error) {
+	t.Helper()
+
+	c, client := net.Pipe()
+	defer c.Close()
+	defer client.Close()
+
+	type result struct {
+		user string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		user, err := s.negotiate(c, "")
+		c.Close()
+		done <- result{user, err}
+	}()
+
+	client.Write([]byte{socks5.Ver, 1, socks5.MethodUsernamePassword})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] == socks5.MethodUsernamePassword {
+		var b bytes.Buffer
+		b.WriteByte(socks5.UserPassVer)
+		b.WriteByte(byte(len(user)))
+		b.WriteString(user)
+		b.WriteByte(byte(len(password)))
+		b.WriteString(password)
+		client.Write(b.Bytes())
+		io.ReadFull(client, reply)
+	}
+
+	r := <-done
+	return r.user, r.err
+}
+
+func TestNegotiateWithoutAuth(t *testing.T) {
+	l := &AuthLimiter{MaxFailures: 1, BackOffFrom: 1}
+	s := &SOCKS5Server{AuthLimiter: l}
+
+	for range 3 {
+		if _, err := negotiateUserPass(t, s, "any", "thing"); err != nil {
+			t.Fatalf("username/password client of an open server rejected: %v", err)
+		}
+	}
+	if _, blocked := l.blocked("pipe"); blocked {
+		t.Error("client of an open server blocked")
+	}
+}
+
+func TestNegotiateUserPass(t *testing.T) {
+	l := &AuthLimiter{MaxFailures: 5, BackOffFrom: 3}
+	s := &SOCKS5Server{Username: "user", Password: "secret", AuthLimiter: l}
+
+	user, err := negotiateUserPass(t, s, "user", "secret")
+	if err != nil || user != "user" {
+		t.Fatalf("got %q, %v, want user", user, err)
+	}
+	if _, err := negotiateUserPass(t, s, "user", "guess"); err != socks5.ErrUserPassAuth {
+		t.Fatalf("got %v with a wrong password, want %v", err, socks5.ErrUserPassAuth)
+	}
+}
@@ -2,30 +2,44 @@ package wiretunnel
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 
 	"github.com/txthinking/socks5"
 )
 
-func (s *SOCKS5Server) tcpHandle(c *net.TCPConn, r *socks5.Request) error {
+func (s *SOCKS5Server) tcpHandle(c net.Conn, r *socks5.Request, user string) error {
+	ip := remoteIP(c.RemoteAddr().String())
+
+	if r.Cmd == socks5.CmdConnect || r.Cmd == socks5.CmdUDP {
+		if err := s.Accounting.checkQuota(user); err != nil {
+			replyFailure(c, r, socks5.RepNotAllowed)
+			return err
+		}
+	}
+
 	if r.Cmd == socks5.CmdConnect {
 		rc, err := s.connect(r, c)
 		if err != nil {
 			return err
 		}
+		rc = s.Accounting.conn(rc, user, r.Address())
+		rc = s.RateLimiter.conn(rc, ip, user, false)
 		defer rc.Close()
-		go c.WriteTo(rc)
-		c.ReadFrom(rc)
+		go io.Copy(rc, c)
+		io.Copy(c, rc)
 		return nil
 	}
 
 	if r.Cmd == socks5.CmdUDP {
-		_, err := r.UDP(c, c.LocalAddr())
+		caddr, err := r.UDP(c, c.LocalAddr())
 		if err != nil {
 			return err
 		}
-		c.WriteTo(io.Discard)
+		a := s.associateUDP(c, r, caddr, user)
+		defer s.dissociateUDP(a)
+		io.Copy(io.Discard, c)
 		return nil
 	}
 
@@ -36,10 +50,14 @@ func (s *SOCKS5Server) connect(r *socks5.Request, w io.Writer) (net.Conn, error)
 	var p *socks5.Reply
 	rc, err := s.dial(context.Background(), "tcp", r.Address())
 	if err != nil {
+		rep := socks5.RepHostUnreachable
+		if errors.Is(err, ErrNotReady) {
+			rep = socks5.RepNetworkUnreachable
+		}
 		if r.Atyp == socks5.ATYPIPv4 || r.Atyp == socks5.ATYPDomain {
-			p = socks5.NewReply(socks5.RepHostUnreachable, socks5.ATYPIPv4, []byte(net.IPv4zero), []byte{0x00, 0x00})
+			p = socks5.NewReply(rep, socks5.ATYPIPv4, []byte(net.IPv4zero), []byte{0x00, 0x00})
 		} else {
-			p = socks5.NewReply(socks5.RepHostUnreachable, socks5.ATYPIPv6, []byte(net.IPv6zero), []byte{0x00, 0x00})
+			p = socks5.NewReply(rep, socks5.ATYPIPv6, []byte(net.IPv6zero), []byte{0x00, 0x00})
 		}
 		if _, err := p.WriteTo(w); err != nil {
 			return nil, err
@@ -74,3 +92,15 @@ func (s *SOCKS5Server) connect(r *socks5.Request, w io.Writer) (net.Conn, error)
 
 	return rc, nil
 }
+
+// replyFailure replies to the request with the failure rep.
+func replyFailure(w io.Writer, r *socks5.Request, rep byte) error {
+	var p *socks5.Reply
+	if r.Atyp == socks5.ATYPIPv4 || r.Atyp == socks5.ATYPDomain {
+		p = socks5.NewReply(rep, socks5.ATYPIPv4, net.IPv4zero.To4(), []byte{0x00, 0x00})
+	} else {
+		p = socks5.NewReply(rep, socks5.ATYPIPv6, net.IPv6zero, []byte{0x00, 0x00})
+	}
+	_, err := p.WriteTo(w)
+	return err
+}
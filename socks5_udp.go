@@ -1,14 +1,150 @@
 package wiretunnel
 
 import (
+	"errors"
 	"fmt"
-	"math/rand/v2"
 	"net"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/txthinking/socks5"
 )
 
+// udpIdleTimeout is the time a UDP exchange is kept without datagrams, the minimum
+// NAT mapping timeout recommended by RFC 4787.
+const udpIdleTimeout = 2 * time.Minute
+
+var errNoUDPAssociation = errors.New("datagram without UDP association")
+
+// udpAssociation is a UDP ASSOCIATE request, its datagrams are accounted to its user
+// and its exchanges are closed when its TCP connection ends. The fields are guarded by
+// the udpMutex of the server.
+type udpAssociation struct {
+	user      string
+	addr      string
+	ip        string
+	exchanges map[string]*socks5.UDPExchange
+	closed    bool
+}
+
+// associateUDP registers the UDP association of the request by the IP of the client
+// TCP connection and the port the request announced, the announced IP is ignored so
+// that a client cannot associate the datagrams of another host. If the request
+// announced no port, the association is bound by the first datagram of the IP.
+func (s *SOCKS5Server) associateUDP(c net.Conn, r *socks5.Request, caddr net.Addr, user string) *udpAssociation {
+	a := &udpAssociation{
+		user:      user,
+		exchanges: make(map[string]*socks5.UDPExchange),
+	}
+
+	ip := addrIP(c.RemoteAddr())
+	announced, ok := caddr.(*net.UDPAddr)
+	// the address of the TCP connection is returned when the request has no port
+	if !ok || (r.DstPort[0] == 0 && r.DstPort[1] == 0) {
+		announced = nil
+	}
+
+	s.udpMutex.Lock()
+	defer s.udpMutex.Unlock()
+
+	if announced != nil {
+		a.addr = (&net.UDPAddr{IP: ip, Port: announced.Port}).String()
+		s.udpAssociations[a.addr] = a
+	} else {
+		a.ip = ip.String()
+		s.udpPending[a.ip] = append(s.udpPending[a.ip], a)
+	}
+	return a
+}
+
+// udpAssociation returns the UDP association of the client UDP address, if any.
+func (s *SOCKS5Server) udpAssociation(addr *net.UDPAddr) *udpAssociation {
+	key := addr.String()
+
+	s.udpMutex.Lock()
+	defer s.udpMutex.Unlock()
+
+	if a, ok := s.udpAssociations[key]; ok {
+		return a
+	}
+
+	// bind the oldest association of the IP waiting for its first datagram
+	ip := addr.IP.String()
+	pending := s.udpPending[ip]
+	if len(pending) == 0 {
+		return nil
+	}
+	a := pending[0]
+	if len(pending) == 1 {
+		delete(s.udpPending, ip)
+	} else {
+		s.udpPending[ip] = pending[1:]
+	}
+	a.addr = key
+	s.udpAssociations[key] = a
+	return a
+}
+
+// dissociateUDP removes the UDP association and closes its exchanges.
+func (s *SOCKS5Server) dissociateUDP(a *udpAssociation) {
+	s.udpMutex.Lock()
+	if a.addr != "" {
+		if s.udpAssociations[a.addr] == a {
+			delete(s.udpAssociations, a.addr)
+		}
+	} else {
+		pending := slices.DeleteFunc(s.udpPending[a.ip], func(p *udpAssociation) bool {
+			return p == a
+		})
+		if len(pending) == 0 {
+			delete(s.udpPending, a.ip)
+		} else {
+			s.udpPending[a.ip] = pending
+		}
+	}
+	a.closed = true
+	exchanges := a.exchanges
+	a.exchanges = nil
+	s.udpMutex.Unlock()
+
+	for _, ue := range exchanges {
+		ue.RemoteConn.Close()
+	}
+}
+
+// addUDPExchange adds the exchange to the association, if any, and reports whether the
+// association is still open.
+func (s *SOCKS5Server) addUDPExchange(a *udpAssociation, key string, ue *socks5.UDPExchange) bool {
+	if a == nil {
+		return true
+	}
+
+	s.udpMutex.Lock()
+	defer s.udpMutex.Unlock()
+
+	if a.closed {
+		return false
+	}
+	a.exchanges[key] = ue
+	return true
+}
+
+func (s *SOCKS5Server) removeUDPExchange(a *udpAssociation, key string) {
+	if a == nil {
+		return
+	}
+
+	s.udpMutex.Lock()
+	delete(a.exchanges, key)
+	s.udpMutex.Unlock()
+}
+
+// authRequired reports whether the clients of the IP must authenticate.
+func (s *SOCKS5Server) authRequired(ip net.IP) bool {
+	return (s.Username != "" || s.ClientCAFile != "") && !containsIP(s.NoAuthList, ip)
+}
+
 func (s *SOCKS5Server) udpHandle(ss *socks5.Server, addr *net.UDPAddr, d *socks5.Datagram) error {
 	src := addr.String()
 	dst := d.Address()
@@ -20,6 +156,17 @@ func (s *SOCKS5Server) udpHandle(ss *socks5.Server, addr *net.UDPAddr, d *socks5
 		return exchangeUDP(ue, d.Data)
 	}
 
+	var user string
+	a := s.udpAssociation(addr)
+	if a != nil {
+		user = a.user
+	} else if s.authRequired(addr.IP) {
+		return fmt.Errorf("%w from %s", errNoUDPAssociation, src)
+	}
+	if err := s.Accounting.checkQuota(user); err != nil {
+		return err
+	}
+
 	var laddr string
 	any, ok = ss.UDPSrc.Get(src + dst)
 	if ok {
@@ -40,14 +187,21 @@ func (s *SOCKS5Server) udpHandle(ss *socks5.Server, addr *net.UDPAddr, d *socks5
 	if laddr == "" {
 		ss.UDPSrc.Set(src+dst, rc.LocalAddr().String(), -1)
 	}
+	rc = s.Accounting.conn(rc, user, dst)
+	rc = s.RateLimiter.conn(rc, addr.IP.String(), user, true)
 
 	ue = &socks5.UDPExchange{
 		ClientAddr: addr,
 		RemoteConn: rc,
 	}
+	if !s.addUDPExchange(a, src+dst, ue) {
+		ue.RemoteConn.Close()
+		return fmt.Errorf("%w from %s", errNoUDPAssociation, src)
+	}
 	err = exchangeUDP(ue, d.Data)
 	if err != nil {
 		ue.RemoteConn.Close()
+		s.removeUDPExchange(a, src+dst)
 		return err
 	}
 	ss.UDPExchanges.Set(src+dst, ue, -1)
@@ -56,6 +210,7 @@ func (s *SOCKS5Server) udpHandle(ss *socks5.Server, addr *net.UDPAddr, d *socks5
 		defer func() {
 			ue.RemoteConn.Close()
 			ss.UDPExchanges.Delete(ue.ClientAddr.String() + dst)
+			s.removeUDPExchange(a, ue.ClientAddr.String()+dst)
 		}()
 		b := make([]byte, 65507)
 		for {
@@ -63,6 +218,7 @@ func (s *SOCKS5Server) udpHandle(ss *socks5.Server, addr *net.UDPAddr, d *socks5
 			if err != nil {
 				return
 			}
+			ue.RemoteConn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
 			a, addr, port, err := socks5.ParseAddress(dst)
 			if err != nil {
 				return
@@ -80,46 +236,17 @@ func (s *SOCKS5Server) udpHandle(ss *socks5.Server, addr *net.UDPAddr, d *socks5
 	return nil
 }
 
+// exchangeUDP sends the datagram of the exchange, which is closed once no datagram
+// has been sent or received for udpIdleTimeout.
 func exchangeUDP(ue *socks5.UDPExchange, data []byte) error {
 	_, err := ue.RemoteConn.Write(data)
 	if err != nil {
 		return err
 	}
+	ue.RemoteConn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
 	return nil
 }
 
 func (s *SOCKS5Server) dialUDP(src, dst string) (net.Conn, error) {
-	laddr, err := net.ResolveUDPAddr("udp", src)
-	if err != nil {
-		return nil, fmt.Errorf("Dial: %w", err)
-	}
-
-	host, port, err := net.SplitHostPort(dst)
-	if err != nil {
-		return nil, fmt.Errorf("Dial: %w", err)
-	}
-
-	addrs, err := s.lookup(host)
-	if err != nil {
-		return nil, fmt.Errorf("Dial: %w", err)
-	}
-
-	host = addrs[rand.IntN(len(addrs))]
-	dst = net.JoinHostPort(host, port)
-	raddr, err := net.ResolveUDPAddr("udp", dst)
-	if err != nil {
-		return nil, fmt.Errorf("Dial: %w", err)
-	}
-
-	if raddr.IP.IsLoopback() || raddr.IP.IsUnspecified() {
-		return nil, fmt.Errorf("Dial: invalid address %s", dst)
-	}
-
-	for _, bypass := range s.BypassList {
-		if bypass.Contains(raddr.IP) {
-			return net.DialUDP("udp", laddr, raddr)
-		}
-	}
-
-	return s.Dialer.DialUDP(laddr, raddr)
+	return dialUDP(s.Dialer, s.lookup, s.BypassList, src, dst)
 }
@@ -0,0 +1,168 @@
+package wiretunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/txthinking/socks5"
+)
+
+// testTCPConn returns the server side of a TCP connection on the loopback interface.
+func testTCPConn(t *testing.T) net.Conn {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func newTestUDPServer() *SOCKS5Server {
+	return &SOCKS5Server{
+		Username:        "user",
+		udpAssociations: make(map[string]*udpAssociation),
+		udpPending:      make(map[string][]*udpAssociation),
+	}
+}
+
+// testAssociate associates the client of the connection with the UDP port it announces,
+// 0 for none.
+func testAssociate(t *testing.T, s *SOCKS5Server, c net.Conn, port int, user string) *udpAssociation {
+	t.Helper()
+
+	r := &socks5.Request{
+		Cmd:     socks5.CmdUDP,
+		Atyp:    socks5.ATYPIPv4,
+		DstAddr: net.IPv4zero.To4(),
+		DstPort: []byte{byte(port >> 8), byte(port)},
+	}
+	// like the socks5 package, use the address of the TCP connection without a port
+	caddr, err := net.ResolveUDPAddr("udp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 0 {
+		caddr = &net.UDPAddr{IP: net.IPv4zero, Port: port}
+	}
+	return s.associateUDP(c, r, caddr, user)
+}
+
+func udpAddr(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestUDPAssociationAnnounced(t *testing.T) {
+	s := newTestUDPServer()
+	a := testAssociate(t, s, testTCPConn(t), 5000, "alice")
+
+	if got := s.udpAssociation(udpAddr(5001)); got != nil {
+		t.Errorf("datagram from another port of the IP associated to %q", got.user)
+	}
+	if got := s.udpAssociation(udpAddr(5000)); got != a {
+		t.Fatalf("datagram from the announced address not associated")
+	}
+
+	s.dissociateUDP(a)
+	if got := s.udpAssociation(udpAddr(5000)); got != nil {
+		t.Errorf("datagram associated after the association ended")
+	}
+}
+
+func TestUDPAssociationForeignIP(t *testing.T) {
+	s := newTestUDPServer()
+	r := &socks5.Request{
+		Cmd:     socks5.CmdUDP,
+		Atyp:    socks5.ATYPIPv4,
+		DstAddr: net.IPv4(192, 0, 2, 9).To4(),
+		DstPort: []byte{0x13, 0x88},
+	}
+	a := s.associateUDP(testTCPConn(t), r, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 5000}, "alice")
+
+	if got := s.udpAssociation(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 5000}); got != nil {
+		t.Errorf("datagram from the announced foreign IP associated to %q", got.user)
+	}
+	if got := s.udpAssociation(udpAddr(5000)); got != a {
+		t.Error("datagram from the IP of the client not associated")
+	}
+}
+
+func TestUDPAssociationPending(t *testing.T) {
+	s := newTestUDPServer()
+	alice := testAssociate(t, s, testTCPConn(t), 0, "alice")
+	bob := testAssociate(t, s, testTCPConn(t), 0, "bob")
+
+	// clients behind the same IP are bound by their first datagram in order
+	if got := s.udpAssociation(udpAddr(6000)); got != alice {
+		t.Fatal("first datagram not bound to the first association")
+	}
+	if got := s.udpAssociation(udpAddr(6000)); got != alice {
+		t.Fatal("second datagram from the same address not bound to the first association")
+	}
+	if got := s.udpAssociation(udpAddr(6001)); got != bob {
+		t.Fatal("datagram from another port not bound to the second association")
+	}
+	if got := s.udpAssociation(udpAddr(6002)); got != nil {
+		t.Errorf("datagram bound to %q without pending association", got.user)
+	}
+
+	carol := testAssociate(t, s, testTCPConn(t), 0, "carol")
+	s.dissociateUDP(carol)
+	if got := s.udpAssociation(udpAddr(6003)); got != nil {
+		t.Errorf("datagram bound to the ended association of %q", got.user)
+	}
+	if len(s.udpPending) != 0 {
+		t.Errorf("%d pending associations left", len(s.udpPending))
+	}
+}
+
+func TestUDPAssociationClosesExchanges(t *testing.T) {
+	s := newTestUDPServer()
+	a := testAssociate(t, s, testTCPConn(t), 5000, "alice")
+
+	remote, peer := net.Pipe()
+	defer peer.Close()
+	ue := &socks5.UDPExchange{ClientAddr: udpAddr(5000), RemoteConn: remote}
+	if !s.addUDPExchange(a, "127.0.0.1:5000192.0.2.1:53", ue) {
+		t.Fatal("exchange not added to the open association")
+	}
+
+	s.dissociateUDP(a)
+	if _, err := remote.Write([]byte("datagram")); err == nil {
+		t.Error("exchange not closed when the association ended")
+	}
+
+	remote, peer = net.Pipe()
+	defer peer.Close()
+	ue = &socks5.UDPExchange{ClientAddr: udpAddr(5000), RemoteConn: remote}
+	if s.addUDPExchange(a, "127.0.0.1:5000192.0.2.2:53", ue) {
+		t.Error("exchange added to the ended association")
+	}
+}
+
+func TestUDPAuthRequired(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.0.0/16")
+	s := &SOCKS5Server{Username: "user", NoAuthList: []*net.IPNet{lan}}
+
+	if !s.authRequired(net.ParseIP("192.0.2.1")) {
+		t.Error("authentication not required")
+	}
+	if s.authRequired(net.ParseIP("192.168.1.1")) {
+		t.Error("authentication required from the no authentication list")
+	}
+	if (&SOCKS5Server{}).authRequired(net.ParseIP("192.0.2.1")) {
+		t.Error("authentication required without credentials")
+	}
+}
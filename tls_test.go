@@ -0,0 +1,182 @@
+package wiretunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key signed by the CA certificate, or self-signed if
+// none.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, ca *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writeFiles writes the certificate and its key in PEM files.
+func (c *testCert) writeFiles(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// newTestTLSProxy returns the address of an HTTP proxy served over TLS with the
+// configuration.
+func newTestTLSProxy(t *testing.T, s *HTTPServer, cfg *tls.Config) string {
+	t.Helper()
+
+	initTestHTTPProxy(t, s)
+	proxy := httptest.NewUnstartedServer(s)
+	proxy.TLS = cfg
+	proxy.StartTLS()
+	t.Cleanup(proxy.Close)
+	return proxy.Listener.Addr().String()
+}
+
+// newHTTPSProxyClient returns a client of the HTTPS proxy trusting its certificate and
+// presenting the client certificates.
+func newHTTPSProxyClient(t *testing.T, proxy string, roots *x509.CertPool, certs ...tls.Certificate) *http.Client {
+	t.Helper()
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: proxy}),
+		TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	cert, err := selfSignedCert("192.0.2.1:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := leaf.VerifyHostname("192.0.2.1"); err != nil {
+		t.Error(err)
+	}
+	if !slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageServerAuth) {
+		t.Error("certificate not for server authentication")
+	}
+
+	cert, err = selfSignedCert("proxy.example.com:8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if err := leaf.VerifyHostname("proxy.example.com"); err != nil {
+		t.Error(err)
+	}
+
+	// unspecified addresses are not valid names
+	cert, err = selfSignedCert(":8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if slices.ContainsFunc(leaf.IPAddresses, net.IP.IsUnspecified) {
+		t.Error("certificate valid for an unspecified address")
+	}
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+	certFile, keyFile := server.writeFiles(t)
+	cfg, err := newTLSConfig(certFile, keyFile, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("got minimum TLS version %x, want 1.2", cfg.MinVersion)
+	}
+
+	proxy := newTestTLSProxy(t, &HTTPServer{}, cfg)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+
+	resp, err := newHTTPSProxyClient(t, proxy, roots).Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("got %d %q through the HTTPS proxy", resp.StatusCode, body)
+	}
+
+	if _, err := newTLSConfig(certFile, filepath.Join(t.TempDir(), "missing.pem"), ""); err == nil {
+		t.Error("missing key file accepted")
+	}
+}
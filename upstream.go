@@ -0,0 +1,137 @@
+package wiretunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/botanica-consulting/wiredialer"
+	"github.com/miekg/dns"
+)
+
+// DNSUpstream describes a DNS server used by the resolver.
+type DNSUpstream struct {
+	// Server is the address of the DNS server. If empty, the DNS server from the WireGuard
+	// configuration is used for tunnel upstreams and the system resolver for local upstreams.
+	Server string
+
+	// Local makes the DNS server reached through the local network instead of the tunnel.
+	Local bool
+}
+
+func (u DNSUpstream) String() string {
+	via := "tunnel"
+	if u.Local {
+		via = "local"
+	}
+	if u.Server == "" {
+		return via
+	}
+	return via + ":" + u.Server
+}
+
+type dnsUpstream struct {
+	server string
+	local  bool
+	dial   dialFunc
+}
+
+var errNoDNSServer = errors.New("no DNS server available")
+
+// newDNSUpstream creates a dnsUpstream from the given DNSUpstream.
+func newDNSUpstream(d *wiredialer.WireDialer, u DNSUpstream) (*dnsUpstream, error) {
+	var server string
+	var err error
+
+	switch {
+	case u.Server != "":
+		server, err = parseDNSServer(u.Server)
+	case u.Local:
+		server, err = systemDNSServer()
+	default:
+		server, err = tunnelDNSServer(d)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	up := &dnsUpstream{
+		server: server,
+		local:  u.Local,
+	}
+	if u.Local {
+		up.dial = (&net.Dialer{}).DialContext
+	} else {
+		up.dial = d.DialContext
+	}
+
+	return up, nil
+}
+
+func (u *dnsUpstream) String() string {
+	if u.local {
+		return "local:" + u.server
+	}
+	return "tunnel:" + u.server
+}
+
+// selectUpstream returns the upstream of the most specific domain matching the host.
+func (r *resolver) selectUpstream(host string) *dnsUpstream {
+	if len(r.domains) == 0 {
+		return r.upstream
+	}
+
+	name := normalizeHost(host)
+	for {
+		if u, ok := r.domains[name]; ok {
+			return u
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return r.upstream
+		}
+		name = name[i+1:]
+	}
+}
+
+func parseDNSServer(s string) (string, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid DNS server %s: %w", s, err)
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid DNS server %s: not an IP address", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func systemDNSServer() (string, error) {
+	cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("failed to read system resolver configuration: %w", err)
+	}
+	if len(cfg.Servers) == 0 {
+		return "", errNoDNSServer
+	}
+	if len(cfg.Servers) > 1 {
+		log.Print("Resolver: WARNING: only the first system DNS server is used")
+	}
+	return net.JoinHostPort(cfg.Servers[0], cfg.Port), nil
+}
+
+func tunnelDNSServer(d *wiredialer.WireDialer) (string, error) {
+	dnsAddrs := d.GetDNS()
+	if len(dnsAddrs) == 0 {
+		return "", errNoDNSServer
+	}
+	if len(dnsAddrs) > 1 {
+		log.Print("Resolver: WARNING: only the first DNS server is used")
+	}
+	return net.JoinHostPort(dnsAddrs[0].String(), "53"), nil
+}
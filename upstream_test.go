@@ -0,0 +1,60 @@
+package wiretunnel
+
+import (
+	"testing"
+)
+
+func TestSelectUpstream(t *testing.T) {
+	def := &dnsUpstream{server: "192.0.2.53:53"}
+	corp := &dnsUpstream{server: "10.0.0.53:53"}
+	lab := &dnsUpstream{server: "10.1.0.53:53", local: true}
+	r := &resolver{
+		upstream: def,
+		domains: map[string]*dnsUpstream{
+			"corp.example":     corp,
+			"lab.corp.example": lab,
+		},
+	}
+
+	tests := []struct {
+		host string
+		want *dnsUpstream
+	}{
+		{host: "example.com", want: def},
+		{host: "corp.example", want: corp},
+		{host: "git.corp.example", want: corp},
+		{host: "GIT.Corp.Example.", want: corp},
+		{host: "lab.corp.example", want: lab},
+		{host: "host.lab.corp.example", want: lab},
+		{host: "notcorp.example", want: def},
+		{host: "example", want: def},
+	}
+
+	for _, tt := range tests {
+		if got := r.selectUpstream(tt.host); got != tt.want {
+			t.Errorf("selectUpstream(%q) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	tests := []struct {
+		server  string
+		want    string
+		wantErr bool
+	}{
+		{server: "10.0.0.53", want: "10.0.0.53:53"},
+		{server: "10.0.0.53:5353", want: "10.0.0.53:5353"},
+		{server: "2001:db8::53", want: "[2001:db8::53]:53"},
+		{server: "[2001:db8::53]:5353", want: "[2001:db8::53]:5353"},
+		{server: "dns.example.com:53", wantErr: true},
+		{server: "dns.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDNSServer(tt.server)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDNSServer(%q) = %q, %v, want %q", tt.server, got, err, tt.want)
+		}
+	}
+}
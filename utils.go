@@ -1,7 +1,13 @@
 package wiretunnel
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -29,3 +35,289 @@ func ParseBypassList(list string) []*net.IPNet {
 
 	return netIPs
 }
+
+// ParseIPList parses a list of IPs and CIDRs separated by commas, unlike ParseBypassList
+// it fails on invalid entries so that a typo does not silently change an access list.
+func ParseIPList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if _, ipnet, err := net.ParseCIDR(s); err == nil {
+			nets = append(nets, ipnet)
+			continue
+		}
+
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return nets, nil
+}
+
+// ParseHostsList parses a list of static host entries in the form host=IP separated by
+// commas, it fails on invalid entries so that a typo does not silently drop an override.
+func ParseHostsList(list string) (map[string][]string, error) {
+	hosts := make(map[string][]string)
+
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		name, addr, ok := strings.Cut(s, "=")
+		name = strings.TrimSpace(name)
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if !ok || name == "" || ip == nil {
+			return nil, fmt.Errorf("invalid host entry %q", strings.TrimSpace(s))
+		}
+
+		hosts[name] = append(hosts[name], ip.String())
+	}
+
+	return hosts, nil
+}
+
+// ParseDNSUpstream parses a DNS upstream in the form tunnel|local[:server].
+func ParseDNSUpstream(s string) (DNSUpstream, error) {
+	via, server, _ := strings.Cut(strings.TrimSpace(s), ":")
+	switch via {
+	case "tunnel":
+		return DNSUpstream{Server: server}, nil
+	case "local":
+		return DNSUpstream{Server: server, Local: true}, nil
+	default:
+		return DNSUpstream{}, fmt.Errorf("invalid DNS upstream %q", s)
+	}
+}
+
+// ParseSplitDNS parses a list of domain=upstream entries separated by commas.
+func ParseSplitDNS(list string) (map[string]DNSUpstream, error) {
+	domains := make(map[string]DNSUpstream)
+
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		domain, upstream, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid split DNS entry %q", s)
+		}
+
+		u, err := ParseDNSUpstream(upstream)
+		if err != nil {
+			return nil, err
+		}
+
+		domains[strings.TrimSpace(domain)] = u
+	}
+
+	return domains, nil
+}
+
+// ParseReverseRoutes parses a list of reverse proxy routes in the form [host]/prefix=URL
+// separated by commas, a route in the form host=URL matches every path of the host.
+func ParseReverseRoutes(list string) ([]ReverseRoute, error) {
+	var routes []ReverseRoute
+
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		match, target, ok := strings.Cut(strings.TrimSpace(s), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid reverse proxy route %q", s)
+		}
+
+		host, prefix, _ := strings.Cut(match, "/")
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reverse proxy route %q: %w", s, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid reverse proxy route %q: upstream must be an http or https URL", s)
+		}
+
+		routes = append(routes, ReverseRoute{
+			Host:   host,
+			Prefix: "/" + prefix,
+			Target: u,
+		})
+	}
+
+	return routes, nil
+}
+
+// ParseHeaderRules parses a list of header rules separated by commas, -Name removes the
+// header and Name:value sets it.
+func ParseHeaderRules(list string) (*HeaderRules, error) {
+	rules := &HeaderRules{Set: make(http.Header)}
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(s, "-"); ok {
+			rules.Remove = append(rules.Remove, strings.TrimSpace(name))
+			continue
+		}
+
+		name, value, ok := strings.Cut(s, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header rule %q", s)
+		}
+		rules.Set.Add(name, strings.TrimSpace(value))
+	}
+
+	return rules, nil
+}
+
+// ParseBearerTokens parses a list of static bearer tokens in the form token=user
+// separated by commas.
+func ParseBearerTokens(list string) (map[string]string, error) {
+	tokens := make(map[string]string)
+
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		token, user, ok := strings.Cut(strings.TrimSpace(s), "=")
+		if !ok || token == "" || user == "" {
+			return nil, fmt.Errorf("invalid bearer token entry %q", s)
+		}
+		tokens[token] = user
+	}
+
+	return tokens, nil
+}
+
+// ParseRate parses a bandwidth limit in bytes per second in the form upload/download, or
+// a single value for both, with an optional K, M or G suffix (powers of 1024).
+func ParseRate(s string) (Rate, error) {
+	up, down, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		down = up
+	}
+
+	upload, err := parseByteSize(up)
+	if err != nil {
+		return Rate{}, fmt.Errorf("invalid rate %q", s)
+	}
+	download, err := parseByteSize(down)
+	if err != nil {
+		return Rate{}, fmt.Errorf("invalid rate %q", s)
+	}
+
+	return Rate{Upload: upload, Download: download}, nil
+}
+
+// ParseUserRates parses a list of user bandwidth limits in the form user=rate separated
+// by commas, with rate in the form of ParseRate.
+func ParseUserRates(list string) (map[string]Rate, error) {
+	rates := make(map[string]Rate)
+
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		user, rate, ok := strings.Cut(strings.TrimSpace(s), "=")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid user rate entry %q", s)
+		}
+
+		r, err := ParseRate(rate)
+		if err != nil {
+			return nil, err
+		}
+		rates[user] = r
+	}
+
+	return rates, nil
+}
+
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	shift := 0
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		}
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, errors.New("invalid size")
+	}
+	return n << shift, nil
+}
+
+// ParseQuota parses a data transfer quota in bytes in the form daily/monthly, with an
+// optional K, M or G suffix (powers of 1024).
+func ParseQuota(s string) (Quota, error) {
+	daily, monthly, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Quota{}, fmt.Errorf("invalid quota %q", s)
+	}
+
+	d, err := parseByteSize(daily)
+	if err != nil {
+		return Quota{}, fmt.Errorf("invalid quota %q", s)
+	}
+	m, err := parseByteSize(monthly)
+	if err != nil {
+		return Quota{}, fmt.Errorf("invalid quota %q", s)
+	}
+
+	return Quota{Daily: d, Monthly: m}, nil
+}
+
+// ParseUserQuotas parses a list of user quotas in the form user=quota separated by
+// commas, with quota in the form of ParseQuota.
+func ParseUserQuotas(list string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+
+		user, quota, ok := strings.Cut(strings.TrimSpace(s), "=")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid user quota entry %q", s)
+		}
+
+		q, err := ParseQuota(quota)
+		if err != nil {
+			return nil, err
+		}
+		quotas[user] = q
+	}
+
+	return quotas, nil
+}
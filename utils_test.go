@@ -0,0 +1,105 @@
+package wiretunnel
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestParseSplitDNS(t *testing.T) {
+	domains, err := ParseSplitDNS("corp.example=tunnel:10.0.0.53, lab.example=local ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]DNSUpstream{
+		"corp.example": {Server: "10.0.0.53"},
+		"lab.example":  {Local: true},
+	}
+	if !maps.Equal(domains, want) {
+		t.Errorf("got %v, want %v", domains, want)
+	}
+
+	for _, list := range []string{"corp.example", "corp.example=vpn:10.0.0.53"} {
+		if domains, err := ParseSplitDNS(list); err == nil {
+			t.Errorf("ParseSplitDNS(%q) = %v, want an error", list, domains)
+		}
+	}
+}
+
+func TestParseHostsList(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{list: "", want: map[string][]string{}},
+		{list: "db.internal=10.0.0.5", want: map[string][]string{"db.internal": {"10.0.0.5"}}},
+		{
+			list: " db.internal = 10.0.0.5 ,db.internal=2001:db8::5,*.svc.internal=10.0.0.6,",
+			want: map[string][]string{
+				"db.internal":    {"10.0.0.5", "2001:db8::5"},
+				"*.svc.internal": {"10.0.0.6"},
+			},
+		},
+		{list: "db.internal", wantErr: true},
+		{list: "db.internal=10.0.0.5,=10.0.0.6", wantErr: true},
+		{list: "db.internal=10.0.0.500", wantErr: true},
+		{list: "db.internal=host.internal", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		hosts, err := ParseHostsList(tt.list)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseHostsList(%q) = %v, want an error", tt.list, hosts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseHostsList(%q) failed: %v", tt.list, err)
+			continue
+		}
+		if !maps.EqualFunc(hosts, tt.want, slices.Equal) {
+			t.Errorf("ParseHostsList(%q) = %v, want %v", tt.list, hosts, tt.want)
+		}
+	}
+}
+
+func TestParseIPList(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: "192.0.2.1", want: []string{"192.0.2.1/32"}},
+		{list: "192.0.2.1, 10.0.0.0/8 ,2001:db8::1,2001:db8::/32,", want: []string{"192.0.2.1/32", "10.0.0.0/8", "2001:db8::1/128", "2001:db8::/32"}},
+		{list: "10.0.0.1/8", want: []string{"10.0.0.0/8"}},
+		{list: "192.0.2.1,192.0.2.300", wantErr: true},
+		{list: "example.com", wantErr: true},
+		{list: "10.0.0.0/33", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		nets, err := ParseIPList(tt.list)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseIPList(%q) = %v, want an error", tt.list, nets)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseIPList(%q) failed: %v", tt.list, err)
+			continue
+		}
+		if len(nets) != len(tt.want) {
+			t.Errorf("ParseIPList(%q) = %v, want %v", tt.list, nets, tt.want)
+			continue
+		}
+		for i, n := range nets {
+			if n.String() != tt.want[i] {
+				t.Errorf("ParseIPList(%q)[%d] = %s, want %s", tt.list, i, n, tt.want[i])
+			}
+		}
+	}
+}